@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// command subcommand of logdownloader, every command owns its flag set
+type command struct {
+	Name  string
+	Args  string
+	Short string
+	// flags register flags of command, common flags are registered for every command
+	flags func(fs *flag.FlagSet)
+	run   func(ctx context.Context, fs *flag.FlagSet) int
+}
+
+var commands = []*command{
+	{Name: "download", Args: "[flags]", Short: "download raw logs of hosts", flags: downloadFlags, run: runDownloadCommand},
+	{Name: "search", Args: "[flags]", Short: "search raw logs of hosts and print their urls without downloading", flags: searchFlags, run: runSearchCommand},
+	{Name: "hosts", Args: "[flags]", Short: "list hosts of account and sub-accounts matching pattern as table, json or csv", flags: hostsFlags, run: runHostsCommand},
+	{Name: "config", Args: "[flags] [command]", Short: "edit configure interactively or by commands, see \"config help\"", flags: configFlags, run: runConfigure},
+	{Name: "state", Args: "[flags] <info|clear>", Short: "show or clear download state", flags: stateFlags, run: runStateCommand},
+	{Name: "keys", Args: "[flags] <command>", Short: "list, rotate and prune credentials, see \"keys\" without command", flags: func(fs *flag.FlagSet) {}, run: runKeys},
+	{Name: "serve", Args: "[flags]", Short: "download raw logs in loop and report status over http", flags: serveFlags, run: runServeCommand},
+}
+
+const usage = `usage: %s [global flags] <command> [flags] [args]
+
+commands:
+%s
+global flags:
+  -config string   configure file or configure scope name (default %q)
+  -log string      loglevel to print, [panic,fatal,error,warn,info,debug,trace] are available value (default %q)
+  -keyfile string  keyfile used to encrypt secrets in configure (default %q)
+
+run "%s help <command>" or "%s <command> -h" for flags of command,
+flags of download are still accepted without command for compatibility
+`
+
+func printUsage() {
+	var b strings.Builder
+	for _, c := range commands {
+		fmt.Fprintf(&b, "  %-10s %s\n", c.Name, c.Short)
+	}
+	fmt.Fprintf(os.Stderr, usage, os.Args[0], b.String(), config, loglevel, keyFile, os.Args[0], os.Args[0])
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// run parse global flags and dispatch command, return exit code
+func run(ctx context.Context, args []string) int {
+	// global flag set accepts every flag of download, so "logdownloader -host x" keeps working
+	global := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	global.SetOutput(ioutil.Discard)
+	commonFlags(global)
+	downloadFlags(global)
+	configFlags(global)
+	if err := global.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			printUsage()
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		printUsage()
+		return 1
+	}
+	if global.NArg() == 0 {
+		if global.NFlag() == 0 {
+			printUsage()
+			return 1
+		}
+		return runCommand(ctx, findCommand("download"), nil)
+	}
+	name := global.Arg(0)
+	if name == "help" {
+		if c := findCommand(global.Arg(1)); c != nil {
+			newFlagSet(c).Usage()
+			return 0
+		}
+		printUsage()
+		return 0
+	}
+	c := findCommand(name)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", name)
+		printUsage()
+		return 1
+	}
+	return runCommand(ctx, c, global.Args()[1:])
+}
+
+func newFlagSet(c *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+	commonFlags(fs)
+	c.flags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s %s\n\n%s\n\nflags:\n", os.Args[0], c.Name, c.Args, c.Short)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runCommand(ctx context.Context, c *command, args []string) int {
+	fs := newFlagSet(c)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	setupLogger()
+	return c.run(ctx, fs)
+}
+
+// flags register flags with current value as default, so values provided before command are kept
+
+func commonFlags(fs *flag.FlagSet) {
+	fs.StringVar(&loglevel, "log", loglevel, "set loglevel to print, [panic,fatal,error,warn,info,debug,trace] are available value")
+	fs.StringVar(&config, "config", config, "use speicaled config file or config scope name, .ini,.yaml,.yml,.json files are supported")
+	fs.StringVar(&keyFile, "keyfile", keyFile, "set keyfile used to encrypt secrets in configure, HW_CONFIG_PASSPHRASE takes precedence")
+	registerOverrideFlags(fs)
+}
+
+func stateFlags(fs *flag.FlagSet) {
+	fs.StringVar(&stateDir, "c", stateDir, "set cache data dir")
+	fs.IntVar(&stateSize, "cs", stateSize, "set cache data maximum size")
+}
+
+func searchFlags(fs *flag.FlagSet) {
+	fs.StringVar(&startFlag, "s", startFlag, "download log from time, RFC3339 with offset, 2006-01-02[ 15:04[:05]] in -tz, now, today, yesterday or relative expression such like -2h, now-1d, today-1w (default 24 hours ago)")
+	fs.StringVar(&endFlag, "e", endFlag, "download log till time, same formats as -s (default now)")
+	fs.StringVar(&timeZone, "tz", timeZone, "time zone of -s/-e without offset and of today/yesterday, such like Asia/Shanghai or Local")
+	fs.StringVar(&hosthashs, "host", hosthashs, "set hosthash, use comma to split multiple hosthash")
+	fs.StringVar(&hostPattern, "pattern", hostPattern, "use hosts match wildcard, use comma to split multiple patterns, pattern without wildcard matches as sub string")
+	hostFilterFlags(fs)
+	fs.StringVar(&onAmbiguous, "on_ambiguous", onAmbiguous, "which hosts to use when more then one hostnames found for -host, prompt|exact|first|all|fail (default prompt when stdin is a terminal, exact otherwise)")
+	fs.StringVar(&onAmbiguous, "on-ambiguous", onAmbiguous, "alias of -on_ambiguous")
+	fs.StringVar(&logtype, "t", logtype, "set logtype, available value cds,cdi, use comma to download multiple types, each type gets its own sub dir of -d then")
+	fs.IntVar(&maxResult, "max", maxResult, "cap search results of each pattern, 0 means all results (up to 10000), a warning is logged when results are truncated")
+	fs.BoolVar(&autoGenerateCredential, "auto", autoGenerateCredential, "auto generate credential(hmac key or private key, based on credential_type), note credential will not generated when there are 3 credentials already exists")
+	fs.BoolVar(&forceGenerate, "force_generate", forceGenerate, "force generate credentials if there are 3 credentials already exists in account")
+	stateFlags(fs)
+}
+
+func downloadFlags(fs *flag.FlagSet) {
+	searchFlags(fs)
+	fs.StringVar(&output, "d", output, "set directory to store logfiles, support local and AWS s3, use {remoteConfigName}:{prefix} when use AWS s3 as destination")
+	fs.IntVar(&worker, "n", worker, "set workers downloading files, they're shared by all hosts")
+	fs.IntVar(&hostWorkers, "host_workers", hostWorkers, "number of hosts downloaded at the same time")
+	fs.IntVar(&retries, "retries", retries, "times a failed api call or download is retried when error is retryable (429, 5xx, timeouts)")
+	fs.DurationVar(&retryWait, "retry_wait", retryWait, "wait before first retry, doubled after each retry with jitter")
+	fs.IntVar(&verifyRetries, "verify_retries", verifyRetries, "times a file is fetched again when checksum or gzip verification fails")
+	fs.DurationVar(&loopInterval, "loop", loopInterval, "loop download logs with a provided time range, zero means disable loop")
+	fs.BoolVar(&fixTime, "fix_time", fixTime, "fix start/end time in loop download mode")
+	fs.BoolVar(&dryRun, "dry_run", dryRun, "print hosts, credential scopes, files and target paths only, nothing is downloaded, generated or saved")
+	fs.BoolVar(&dryRun, "dry-run", dryRun, "alias of -dry_run")
+	fs.StringVar(&outputFormat, "format", outputFormat, "format of -dry_run plan, table or json")
+}
+
+func configFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&showSecret, "show_secret", showSecret, "show secert data instead of hide them")
+}
+
+func runDownloadCommand(ctx context.Context, fs *flag.FlagSet) int {
+	if !hostSelected() {
+		logger.Error().Msg("host/pattern/regex/account must provided")
+		return 1
+	}
+	if outputFormat != "table" && outputFormat != "json" {
+		logger.Error().Msgf("invalid -format %s, table or json expected", outputFormat)
+		return 1
+	}
+	if dryRun {
+		// nothing is saved in dry run, not even migrated configure
+		configReadOnly = true
+	}
+	if code := setupConfigure(false); code != 0 {
+		return code
+	}
+	if _, e := os.Stat(configFile); autoGenerateCredential && os.IsNotExist(e) {
+		// generated credential couldn't been saved, so every run would generate another one
+		logger.Error().Str("config", configFile).Msg("-auto needs configure file to save generated credential, create it by config set or provide credential by flags/env")
+		return 3
+	}
+	if err := parseTimeRange(); err != nil {
+		logger.Error().Err(err).Msg("invalid time range")
+		return 1
+	}
+	return runDownload(ctx)
+}
+
+func runSearchCommand(ctx context.Context, fs *flag.FlagSet) int {
+	if !hostSelected() {
+		logger.Error().Msg("host/pattern/regex/account must provided")
+		return 1
+	}
+	if code := setupConfigure(false); code != 0 {
+		return code
+	}
+	if err := parseTimeRange(); err != nil {
+		logger.Error().Err(err).Msg("invalid time range")
+		return 1
+	}
+	types, err := logTypes()
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid -t")
+		return 1
+	}
+	api, cu, code := login()
+	if code != 0 {
+		return code
+	}
+	hosts, code := resolveHosts(api, cu)
+	if code != 0 {
+		return code
+	}
+	for _, h := range hosts {
+		hcred, code := hostCredential(api, cu, h)
+		if code != 0 {
+			return code
+		}
+		for _, t := range types {
+			urls, err := searchLogs(api, h, t, hcred)
+			if err != nil {
+				logger.Error().Err(err).Str("host_hash", h.HostHash).Time("from", start).Time("to", end).Str("type", t).Msg("search logs failed")
+				return 1
+			}
+			logger.Info().Str("host_hash", h.Name+"("+h.HostHash+")").Time("from", start).Time("to", end).Str("type", t).Int("file_number", len(urls)).Msg("search raw log succeed")
+			for _, u := range urls {
+				fmt.Println(u)
+			}
+		}
+	}
+	return 0
+}
+
+func runConfigure(ctx context.Context, fs *flag.FlagSet) int {
+	if fs.Arg(0) == "validate" {
+		// file is validated as it is, migration must not rewrite it first
+		configReadOnly = true
+	}
+	if code := setupConfigure(true); code != 0 {
+		return code
+	}
+	if fs.NArg() > 0 {
+		return runConfigCommand(Cfg, fs.Args())
+	}
+	Cfg = Cfg.editConfig()
+	if err := Cfg.save(); err != nil {
+		logger.Error().Err(err).Msg("edit configure failed")
+		return configExitSave
+	}
+	return configExitOK
+}
+
+func runKeys(ctx context.Context, fs *flag.FlagSet) int {
+	if code := setupConfigure(false); code != 0 {
+		return code
+	}
+	api, cu, code := login()
+	if code != 0 {
+		return code
+	}
+	return runKeysCommand(api, cu, fs.Args())
+}
+
+// runStateCommand show size of download state or remove it, so files would been downloaded again
+func runStateCommand(ctx context.Context, fs *flag.FlagSet) int {
+	switch fs.Arg(0) {
+	case "info":
+		var files, size int64
+		var modified time.Time
+		err := filepath.Walk(stateDir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			files++
+			size += info.Size()
+			if info.ModTime().After(modified) {
+				modified = info.ModTime()
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			logger.Error().Err(err).Str("state_dir", stateDir).Msg("read state failed")
+			return 1
+		}
+		fmt.Printf("path:     %s\nfiles:    %d\nsize:     %d/%d bytes\n", stateDir, files, size, stateSize)
+		if files > 0 {
+			fmt.Printf("modified: %s\n", modified.UTC().Format(time.RFC3339))
+		}
+		return 0
+	case "clear":
+		cfs := flag.NewFlagSet("state clear", flag.ContinueOnError)
+		yes := cfs.Bool("yes", false, "remove state without confirmation")
+		if err := cfs.Parse(fs.Args()[1:]); err != nil {
+			return 1
+		}
+		if !*yes {
+			confirm := scanInput{
+				Placeholder: fmt.Sprintf("remove download state %s, all logs would been downloaded again: ", stateDir),
+				Default:     "no",
+				Options: []*inputOptions{
+					&inputOptions{Value: "yes", Label: "remove state"},
+					&inputOptions{Value: "no", Label: "keep state"},
+				},
+			}.scan()
+			if confirm != "yes" {
+				return 0
+			}
+		}
+		if err := os.RemoveAll(stateDir); err != nil {
+			logger.Error().Err(err).Str("state_dir", stateDir).Msg("remove state failed")
+			return 1
+		}
+		fmt.Printf("%s removed\n", stateDir)
+		return 0
+	}
+	fs.Usage()
+	return 1
+}
@@ -1,24 +1,42 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"gopkg.in/ini.v1"
 )
 
 type configure struct {
-	AuthType        string `ini:"auth_type,omitempty" comment:"striketracker auth method, available options basic,token"`
-	Username        string `ini:"user_name,omitempty" comment:"striketracker username"`
-	Password        string `ini:"password,omitempty"`
-	Token           string `ini:"token,omitempty"`
-	PrivateKeyJSON  string `ini:"private_key_json,omitempty"`
-	AccessKeyID     string `ini:"access_key_id,omitempty"`
-	SecretAccessKey string `ini:"secret_access_key,omitempty"`
-	BucketName      string `ini:"bucket_name,omitempty"`
-	Region          string `ini:"region,omitempty" comment:"region"`
-	Provider        string `ini:"provider,omitempty" comment:"remote storage service provider, only AWS S3 supported in remote configure"`
+	Inherits          string `ini:"inherits,omitempty" comment:"scope to inherit unset keys from, default scope is inherited at last"`
+	AuthType          string `ini:"auth_type,omitempty" comment:"striketracker auth method, available options basic,token"`
+	Username          string `ini:"user_name,omitempty" comment:"striketracker username"`
+	Password          string `ini:"password,omitempty"`
+	Token             string `ini:"token,omitempty"`
+	CredentialType    string `ini:"credential_type,omitempty" comment:"credential used to access raw logs, available options hmac,private_key"`
+	PrivateKeyJSON    string `ini:"private_key_json,omitempty" comment:"base64 encoded service account private key json"`
+	AccessKeyID       string `ini:"access_key_id,omitempty"`
+	SecretAccessKey   string `ini:"secret_access_key,omitempty"`
+	CredentialCreated string `ini:"credential_created,omitempty" comment:"creation time of generated credential"`
+	RotateAfter       string `ini:"rotate_after,omitempty" comment:"rotate generated credential once it's older than this duration, e.g. 720h"`
+	PasswordFile      string `ini:"password_file,omitempty" comment:"read password from file when password is empty"`
+	PasswordCommand   string `ini:"password_command,omitempty" comment:"read password from stdout of command when password is empty"`
+	TokenFile         string `ini:"token_file,omitempty"`
+	TokenCommand      string `ini:"token_command,omitempty"`
+	SecretKeyFile     string `ini:"secret_access_key_file,omitempty"`
+	SecretKeyCommand  string `ini:"secret_access_key_command,omitempty"`
+	VaultPath         string `ini:"vault_path,omitempty" comment:"vault KV secret path such like secret/data/highwinds, keys of secret fill empty keys of scope"`
+	VaultAddr         string `ini:"vault_addr,omitempty" comment:"vault address, VAULT_ADDR is used when empty, token is read from VAULT_TOKEN or ~/.vault-token"`
+	BucketName        string `ini:"bucket_name,omitempty"`
+	Region            string `ini:"region,omitempty" comment:"region"`
+	Provider          string `ini:"provider,omitempty" comment:"remote storage service provider, only AWS S3 supported in remote configure"`
 }
 
 type nsConfigure map[string]*configure
@@ -26,6 +44,15 @@ type nsConfigure map[string]*configure
 var (
 	// Cfg global variable contains configure data
 	configFile string = homeDir(".highwinds", "hcs.ini")
+	// configSnapshot scopes read from configure file by this process
+	configSnapshot map[string]configure = make(map[string]configure)
+	// cfgMu guards Cfg and accountMu while hosts are downloaded concurrently, it's only held while Cfg is read
+	// or changed, never across api calls, and taken after lock of lockConfig when both are needed
+	cfgMu sync.Mutex
+	// accountMu locks of accounts held while credential of account is resolved, so it's generated or rotated once
+	accountMu = make(map[string]*sync.Mutex)
+	// saveMu serializes lockConfig of this process, file lock only guards against other processes
+	saveMu sync.Mutex
 )
 
 func homeDir(s ...string) string {
@@ -37,50 +64,370 @@ func homeDir(s ...string) string {
 }
 
 func loadConfig() (nsConfigure, error) {
+	nc, meta, err := readConfig(configFile)
+	if err != nil {
+		return nc, err
+	}
+	// secrets are kept encrypted when they were, config encrypt/decrypt overrides it
+	configEncrypted = meta.encrypted
+	configSnapshot = nc.snapshot()
+	version := meta.version
+	if version < configVersion && !configReadOnly {
+		// migrated configure is used in memory only until problems of file are fixed
+		if problems, e := validateConfig(configFile); e != nil || len(problems) > 0 {
+			for _, p := range problems {
+				logger.Warn().Str("problem", p).Msg("configure not migrated on disk, run config validate")
+			}
+			return nc, e
+		}
+		if e := nc.saveMigrated(version); e != nil {
+			return nc, fmt.Errorf("save migrated configure failed %s", e.Error())
+		}
+	}
+	return nc, nil
+}
+
+// saveMigrated keep original file as .v{version}.bak, then save migrated one, both under lock of lockConfig;
+// migration is skipped when backup fails or other process has migrated the file already
+func (nc nsConfigure) saveMigrated(version int) error {
+	unlock, err := lockConfig()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, meta, e := readConfig(configFile); e != nil || meta.version >= configVersion {
+		return e
+	}
+	backup := fmt.Sprintf("%s.v%d.bak", configFile, version)
+	b, err := ioutil.ReadFile(configFile)
+	if err == nil {
+		err = ioutil.WriteFile(backup, b, 0600)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Str("backup", backup).Msg("backup configure failed, configure not migrated on disk")
+		return nil
+	}
+	if err := nc.saveLocked(); err != nil {
+		return err
+	}
+	logger.Info().Int("from", version).Int("to", configVersion).Str("backup", backup).Msg("configure migrated")
+	return nil
+}
+
+// configMeta properties of configure file reported by readConfig
+type configMeta struct {
+	// version schema version of file before migration
+	version int
+	// encrypted whether file carries encrypted marker or any secret is stored encrypted
+	encrypted bool
+	// unknown keys of each scope which are not configure fields, they're written back on save
+	unknown map[string]map[string]string
+}
+
+// readConfig read configure file, secrets are decrypted and older schema are migrated,
+// version of configure file and whether it's encrypted are returned as well
+func readConfig(path string) (nsConfigure, configMeta, error) {
 	var nc nsConfigure = make(nsConfigure)
-	cfg, err := ini.Load(configFile)
+	var meta configMeta
+	raw, err := decodeConfig(path)
+	if err != nil {
+		return nc, meta, err
+	}
+	if meta.encrypted, err = takeEncryptedMarker(raw); err != nil {
+		return nc, meta, err
+	}
+	for name, kv := range raw {
+		for _, k := range secretKeys {
+			if !strings.HasPrefix(kv[k], encPrefix) {
+				continue
+			}
+			v, e := decryptValue(kv[k])
+			if e != nil {
+				return nc, meta, fmt.Errorf("parse section %s error decrypt %s failed %s", name, k, e.Error())
+			}
+			kv[k] = v
+			meta.encrypted = true
+		}
+	}
+	meta.version, err = migrateConfig(raw)
 	if err != nil {
-		return nc, fmt.Errorf("read config failed, please run " + os.Args[0] + " config")
+		return nc, meta, err
 	}
-	for _, section := range cfg.Sections() {
+	meta.unknown = make(map[string]map[string]string)
+	for name, kv := range raw {
 		c := configure{}
-		if e := section.MapTo(&c); e != nil {
-			return nc, fmt.Errorf("parse section %s error %s", section.Name(), e.Error())
+		for k, v := range kv {
+			// unknown keys are reported by config validate and kept by save
+			if f, ok := c.field(k); ok {
+				f.SetString(v)
+			} else {
+				if meta.unknown[name] == nil {
+					meta.unknown[name] = make(map[string]string)
+				}
+				meta.unknown[name][k] = v
+			}
 		}
-		nc[section.Name()] = &c
+		nc[name] = &c
 	}
-	return nc, nil
+	return nc, meta, nil
+}
+
+// snapshot copy values of all scopes, used to find out scopes changed by this process
+func (nc nsConfigure) snapshot() map[string]configure {
+	res := make(map[string]configure, len(nc))
+	for k, c := range nc {
+		if c != nil {
+			res[k] = *c
+		}
+	}
+	return res
+}
+
+// credentialKeys keys bound to account, they're never inherited from scope of other account
+var credentialKeys = []string{"private_key_json", "access_key_id", "secret_access_key", "secret_access_key_file", "secret_access_key_command", "vault_path", "credential_created"}
+
+// resolve merge scope with scopes it inherits, default section is the implicit root,
+// inherits accepts scope names as CLI does, so "default" is the default section
+func (nc nsConfigure) resolve(name string) (*configure, error) {
+	var chain []*configure
+	seen := make(map[string]bool)
+	for n := name; n != ""; {
+		if seen[n] {
+			return nil, fmt.Errorf("inherits loop found at scope %s", n)
+		}
+		seen[n] = true
+		c := nc[n]
+		if c == nil {
+			if n != name {
+				return nil, fmt.Errorf("scope %s inherited by %s not found", n, name)
+			}
+			break
+		}
+		chain = append(chain, c)
+		n = scopeName(c.Inherits)
+	}
+	if !seen[ini.DefaultSection] {
+		chain = append(chain, nc[ini.DefaultSection])
+	}
+	return mergeConfigure(chain...), nil
 }
 
-// Default return default configure
-func (nc nsConfigure) Default(scopename ...string) *configure {
-	for n := range nc {
-		if len(scopename) > 0 && n == scopename[0] {
-			return nc[scopename[0]]
+// accountConfigure resolve scope of accountHash, credentials are inherited only by currentAccount
+// since credentials of one account never work for another
+func (nc nsConfigure) accountConfigure(accountHash, currentAccount string) (*configure, error) {
+	c, err := nc.resolve(accountHash)
+	if err != nil || accountHash == currentAccount {
+		return c, err
+	}
+	own := nc[accountHash]
+	if own == nil {
+		own = &configure{}
+	}
+	for _, k := range credentialKeys {
+		v, _ := own.get(k)
+		c.set(k, v)
+	}
+	return c, nil
+}
+
+// credentialScope name of scope which provides credential of accountHash, empty when there is none,
+// it follows the same rules as accountConfigure
+func (nc nsConfigure) credentialScope(accountHash, currentAccount string) string {
+	holds := func(c *configure) bool {
+		for _, k := range credentialKeys {
+			if v, _ := c.get(k); v != "" && k != "credential_created" {
+				return true
+			}
+		}
+		return false
+	}
+	if accountHash != currentAccount {
+		if c := nc[accountHash]; c != nil && holds(c) {
+			return accountHash
 		}
+		return ""
+	}
+	seen := make(map[string]bool)
+	for n := accountHash; n != "" && !seen[n] && nc[n] != nil; n = scopeName(nc[n].Inherits) {
+		seen[n] = true
+		if holds(nc[n]) {
+			return n
+		}
+	}
+	if c := nc[ini.DefaultSection]; c != nil && !seen[ini.DefaultSection] && holds(c) {
+		return ini.DefaultSection
+	}
+	return ""
+}
+
+// copyCredential copy credential keys from src
+func (config *configure) copyCredential(src *configure) {
+	config.CredentialType = src.CredentialType
+	for _, k := range credentialKeys {
+		v, _ := src.get(k)
+		config.set(k, v)
 	}
-	return nc[ini.DefaultSection]
 }
+
+// lockConfig lock configure against other goroutines and processes, returned func releases the lock
+func lockConfig() (func(), error) {
+	saveMu.Lock()
+	os.MkdirAll(filepath.Dir(configFile), 0700)
+	unlock, err := lockFile(configFile + ".lock")
+	if err != nil {
+		saveMu.Unlock()
+		return nil, fmt.Errorf("lock configure failed %s", err.Error())
+	}
+	return func() {
+		unlock()
+		saveMu.Unlock()
+	}, nil
+}
+
+// save merge scopes changed by this process into configure file, file is locked during
+// read-modify-write, written to temp file then renamed, previous version is kept as .bak
 func (nc nsConfigure) save() error {
-	os.Mkdir(configFile[:strings.LastIndex(configFile, "/")], 0700)
-	f, _ := os.OpenFile(configFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	f.Close()
-	cfg := ini.Empty()
-	for k, c := range nc {
-		cc, e := cfg.NewSection(k)
+	if configReadOnly {
+		return nil
+	}
+	unlock, err := lockConfig()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return nc.saveLocked()
+}
+
+// updateConfig change Cfg by fn under cfgMu and save it, safe while hosts are downloaded concurrently,
+// Cfg is changed even when configure can't been locked
+func updateConfig(fn func()) error {
+	var err error
+	if !configReadOnly {
+		var unlock func()
+		if unlock, err = lockConfig(); err == nil {
+			defer unlock()
+		}
+	}
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+	fn()
+	if configReadOnly || err != nil {
+		return err
+	}
+	return Cfg.saveLocked()
+}
+
+// lockAccount lock credential of account, returned func unlocks it
+func lockAccount(accountHash string) func() {
+	cfgMu.Lock()
+	m := accountMu[accountHash]
+	if m == nil {
+		m = &sync.Mutex{}
+		accountMu[accountHash] = m
+	}
+	cfgMu.Unlock()
+	m.Lock()
+	return m.Unlock
+}
+
+// saveLocked save while lock of lockConfig is held
+func (nc nsConfigure) saveLocked() error {
+	merged := make(nsConfigure)
+	var unknown map[string]map[string]string
+	encrypted := configEncrypted
+	old, err := ioutil.ReadFile(configFile)
+	if err == nil {
+		// other process may have changed configure since we loaded it
+		disk, meta, e := readConfig(configFile)
 		if e != nil {
 			return e
 		}
-		if e := cc.ReflectFrom(c); e != nil {
-			return e
+		unknown = meta.unknown
+		// other process may have encrypted or decrypted it as well
+		if !configEncryptSet {
+			encrypted = meta.encrypted
+		}
+		for k, c := range disk {
+			merged[k] = c
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for k, c := range nc {
+		if c == nil {
+			continue
+		}
+		if s, ok := configSnapshot[k]; ok && s == *c {
+			continue
+		}
+		merged[k] = c
+	}
+	for k := range configSnapshot {
+		if nc[k] == nil {
+			delete(merged, k)
+		}
+	}
+
+	out := make(nsConfigure, len(merged))
+	for k, c := range merged {
+		if encrypted {
+			ec := *c
+			if e := ec.encryptSecrets(); e != nil {
+				return e
+			}
+			c = &ec
 		}
+		out[k] = c
 	}
-	if e := cfg.SaveTo(configFile); e != nil {
+	write, err := encodeConfig(configFile, out, encrypted, unknown)
+	if err != nil {
+		return err
+	}
+	if e := writeFileAtomic(configFile, write); e != nil {
 		return e
 	}
+	if old != nil {
+		ioutil.WriteFile(configFile+".bak", old, 0600)
+	}
+	configEncrypted = encrypted
+
+	for k := range nc {
+		if merged[k] == nil {
+			delete(nc, k)
+		}
+	}
+	for k, c := range merged {
+		nc[k] = c
+	}
+	configSnapshot = nc.snapshot()
 	return nil
 }
 
+// writeFileAtomic write file to temp file in same dir, then rename it to path
+func writeFileAtomic(path string, write func(w io.Writer) (int64, error)) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".hcs-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
 func (nc nsConfigure) printCurrentConfig() {
 	fmt.Printf("# %-15s\t%-20s\t%-10s\t%-8s\t%-15s\t%-15s", "ConfigureScope", "Username", "Password", "Token", "PrivateKeyJSON", "AccessKey&Secret\n")
 	i := 1
@@ -155,6 +502,7 @@ func (nc nsConfigure) editConfig() nsConfigure {
 				}
 				nc[configScope].collect()
 			}
+			nc.verifyScope(configScope)
 			continue
 		case "edit":
 			if len(nc) == 0 {
@@ -190,6 +538,7 @@ func (nc nsConfigure) editConfig() nsConfigure {
 				} else {
 					nc[n].collect()
 				}
+				nc.verifyScope(n)
 			}
 			continue
 		case "delete":
@@ -282,46 +631,59 @@ func (config *configure) collect() {
 		}
 		break
 	}
-	/*
-		credentialType := scanInput{Placeholder: "Select credential type you prefer:", Options: []*inputOptions{
-			&inputOptions{Label: "privateKey, unknow as privateKeyJSON", Value: "privateKey"},
-			&inputOptions{Label: "accessID+secretKey, simliar to AWS S3 credentials", Value: "secretKey"},
-		}, Default: "privateKey", Minlength: 1}.scan()
-		for {
-			switch credentialType {
-			case "privateKey":
-				config.PrivateKeyJSON = scanInput{Placeholder: "Input your private key json file path or base64 encoded string :", Default: config.PrivateKeyJSON, Password: true, Vaild: func(s *string) (bool, error) {
-					if len(*s) < 1 {
-						return false, fmt.Errorf("cannot been null")
-					}
-					b, e := ioutil.ReadFile(*s) //os.OpenFile(config.PrivateKeyJSON, os.O_RDONLY, 0600)
-					if e != nil {
-						_, e := base64.StdEncoding.DecodeString(config.PrivateKeyJSON)
-						if e != nil || config.PrivateKeyJSON == "" {
-							return false, fmt.Errorf("Input error, no such file and input is not vaild base64 encoded string")
-						}
-					} else {
-						// read config from file
-						if !json.Valid(b) {
-							return false, fmt.Errorf("The private key json file doesn't vaild JSON content")
-						}
-						*s = base64.StdEncoding.EncodeToString(b)
-					}
-					return true, nil
-				}}.scan()
-			case "secretKey":
-				config.AccessKeyID = scanInput{Placeholder: "Input your access key ID : ", Default: config.AccessKeyID, Minlength: 10}.scan()
-				config.SecretAccessKey = scanInput{Placeholder: "Input your secret key : ", Default: config.SecretAccessKey, Password: true, Minlength: 10}.scan()
-			default:
-				continue
+	if config.CredentialType == "" {
+		config.CredentialType = "private_key"
+	}
+	config.CredentialType = scanInput{Placeholder: "Select credential type you prefer:", Options: []*inputOptions{
+		&inputOptions{Label: "service account private key json, generated by -auto when absent", Value: "private_key"},
+		&inputOptions{Label: "accessID+secretKey(HMAC key), simliar to AWS S3 credentials, generated by -auto when absent", Value: "hmac"},
+		&inputOptions{Label: "skip, leave credential empty", Value: "skip"},
+	}, Default: config.CredentialType, Minlength: 1}.scan()
+	switch config.CredentialType {
+	case "private_key":
+		config.PrivateKeyJSON = scanInput{Placeholder: "Input your private key json file path or base64 encoded string, leave it empty to generate by -auto :", Default: config.PrivateKeyJSON, Password: true, Vaild: func(s *string) (bool, error) {
+			if *s == "" {
+				return true, nil
 			}
-			break
-		}*/
+			v, e := parsePrivateKeyJSON(*s)
+			if e != nil {
+				return false, e
+			}
+			*s = v
+			return true, nil
+		}}.scan()
+	case "hmac":
+		config.AccessKeyID = scanInput{Placeholder: "Input your access key ID, leave it empty to generate by -auto : ", Default: config.AccessKeyID}.scan()
+		config.SecretAccessKey = scanInput{Placeholder: "Input your secret key : ", Default: config.SecretAccessKey, Password: true}.scan()
+	default:
+		config.CredentialType = ""
+	}
+}
+
+// parsePrivateKeyJSON accept private key json file path or base64 encoded json, return base64 encoded json
+func parsePrivateKeyJSON(s string) (string, error) {
+	b, e := ioutil.ReadFile(s)
+	if e != nil {
+		if b, e = base64.StdEncoding.DecodeString(s); e != nil {
+			return "", fmt.Errorf("input error, no such file and input is not vaild base64 encoded string")
+		}
+	}
+	if !json.Valid(b) {
+		return "", fmt.Errorf("the private key doesn't contain vaild JSON content")
+	}
+	var key struct {
+		Type       string `json:"type"`
+		PrivateKey string `json:"private_key"`
+	}
+	if json.Unmarshal(b, &key); key.Type != "service_account" || key.PrivateKey == "" {
+		return "", fmt.Errorf("the private key json is not a service account key")
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
 }
 
 func inSlice(slice []string, ele string) bool {
 	for i := 0; i <= len(slice)-1; i++ {
-		if slice[0] == ele {
+		if slice[i] == ele {
 			return true
 		}
 	}
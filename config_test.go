@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestSaveMergesScopesOfOtherProcess(t *testing.T) {
+	defer useTempConfig(t, "version = 2\nuser_name = u\npassword = p\n")()
+	a, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotA := configSnapshot
+	// other process loads the same file and saves another scope
+	b, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b["e5f6g7h8"] = &configure{AccessKeyID: "id-b", SecretAccessKey: "s-b"}
+	if err := b.save(); err != nil {
+		t.Fatal(err)
+	}
+	configSnapshot = snapshotA
+	a["a1b2c3d4"] = &configure{AccessKeyID: "id-a", SecretAccessKey: "s-a"}
+	if err := a.save(); err != nil {
+		t.Fatal(err)
+	}
+	disk, _, err := readConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for scope, id := range map[string]string{"a1b2c3d4": "id-a", "e5f6g7h8": "id-b"} {
+		if disk[scope] == nil || disk[scope].AccessKeyID != id {
+			t.Errorf("scope %s = %+v, want access_key_id %s", scope, disk[scope], id)
+		}
+	}
+	if disk[ini.DefaultSection].Username != "u" {
+		t.Errorf("default scope = %+v, want user_name u", disk[ini.DefaultSection])
+	}
+	// scopes saved by other process are picked up in memory as well
+	if a["e5f6g7h8"] == nil {
+		t.Error("scope saved by other process is missing after save")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	nc := nsConfigure{
+		ini.DefaultSection: {Username: "u", Password: "p", AccessKeyID: "default-id"},
+		"base":             {AuthType: "token", Token: "t"},
+		"team":             {Inherits: "base", RotateAfter: "720h"},
+		"a1b2c3d4":         {Inherits: "team", AccessKeyID: "own-id"},
+		"b1b2c3d4":         {Inherits: "default", Username: "other"},
+		"c1b2c3d4":         {Inherits: "Default", Token: "own"},
+		"loop1":            {Inherits: "loop2"},
+		"loop2":            {Inherits: "loop1"},
+		"d1b2c3d4":         {Inherits: "loop1"},
+		"e1b2c3d4":         {Inherits: "missing"},
+	}
+	cases := []struct {
+		scope   string
+		want    configure
+		wantErr bool
+	}{
+		{"a1b2c3d4", configure{Inherits: "team", AuthType: "token", Username: "u", Password: "p", Token: "t", AccessKeyID: "own-id", RotateAfter: "720h"}, false},
+		{"team", configure{Inherits: "base", AuthType: "token", Username: "u", Password: "p", Token: "t", AccessKeyID: "default-id", RotateAfter: "720h"}, false},
+		{"b1b2c3d4", configure{Inherits: "default", Username: "other", Password: "p", AccessKeyID: "default-id"}, false},
+		{"c1b2c3d4", configure{Inherits: "Default", Username: "u", Password: "p", Token: "own", AccessKeyID: "default-id"}, false},
+		// scope without section resolves to default section
+		{"f1b2c3d4", configure{Username: "u", Password: "p", AccessKeyID: "default-id"}, false},
+		{"d1b2c3d4", configure{}, true},
+		{"loop1", configure{}, true},
+		{"e1b2c3d4", configure{}, true},
+	}
+	for _, c := range cases {
+		got, err := nc.resolve(c.scope)
+		if (err != nil) != c.wantErr {
+			t.Errorf("resolve(%s) error %v, want error %t", c.scope, err, c.wantErr)
+			continue
+		}
+		if err == nil && *got != c.want {
+			t.Errorf("resolve(%s) = %+v, want %+v", c.scope, *got, c.want)
+		}
+	}
+}
+
+func TestAccountConfigure(t *testing.T) {
+	nc := nsConfigure{
+		ini.DefaultSection: {Username: "u", Password: "p", CredentialType: "hmac", AccessKeyID: "default-id", SecretAccessKey: "default-secret"},
+		"team":             {Inherits: "default", PrivateKeyJSON: "team-key"},
+		"a1b2c3d4":         {Inherits: "team"},
+		"b1b2c3d4":         {Inherits: "team", AccessKeyID: "own-id", SecretAccessKey: "own-secret"},
+	}
+	cases := []struct {
+		account, current string
+		id, key, scope   string
+	}{
+		// current account inherits credentials
+		{"a1b2c3d4", "a1b2c3d4", "default-id", "team-key", "team"},
+		// other accounts only use their own
+		{"a1b2c3d4", "c1c2c3c4", "", "", ""},
+		{"b1b2c3d4", "c1c2c3c4", "own-id", "", "b1b2c3d4"},
+		{"c1b2c3d4", "c1b2c3d4", "default-id", "", ini.DefaultSection},
+	}
+	for _, c := range cases {
+		got, err := nc.accountConfigure(c.account, c.current)
+		if err != nil {
+			t.Errorf("accountConfigure(%s, %s) failed %s", c.account, c.current, err)
+			continue
+		}
+		if got.AccessKeyID != c.id || got.PrivateKeyJSON != c.key || got.Username != "u" {
+			t.Errorf("accountConfigure(%s, %s) = %+v, want access_key_id %q, private_key_json %q", c.account, c.current, *got, c.id, c.key)
+		}
+		if s := nc.credentialScope(c.account, c.current); s != c.scope {
+			t.Errorf("credentialScope(%s, %s) = %q, want %q", c.account, c.current, s, c.scope)
+		}
+	}
+}
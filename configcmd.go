@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// secretKeys keys which value would been hidden unless -show_secret provided
+var secretKeys = []string{"password", "token", "private_key_json", "secret_access_key"}
+
+const configUsage = `usage: %s [flags] config [command]
+
+commands:
+  (none)                              launch interactive configure editor
+  list                                print all configure scopes
+  get <scope> [key]                   print all keys of scope, or value of key
+  set <scope> <key>=<value> ...       create or update scope, empty value clears key
+                                      private_key_json accepts file path or base64 encoded json
+  delete <scope>                      delete scope, refused while other scopes inherit it
+  rename <scope> <new-scope>          rename scope, inherits of other scopes follow it
+  encrypt                             encrypt secrets stored in configure file
+  decrypt                             decrypt secrets stored in configure file
+  convert <src> <dst>                 convert configure file, format detected by extension(.ini,.yaml,.yml,.json)
+  validate                            report unknown keys, invalid scope names and missing required keys
+  test [scope]                        check credentials of scope or all scopes against striketracker api and remote bucket
+
+secrets are encrypted by passphrase in HW_CONFIG_PASSPHRASE when it's set,
+otherwise by local keyfile (see -keyfile), keyfile will been created when absent
+
+use "default" as scope name to access default/global configure
+available keys: %s
+`
+
+// exit codes of config commands
+const (
+	configExitOK       = 0
+	configExitUsage    = 1
+	configExitSave     = 3
+	configExitNotFound = 6
+	configExitInvalid  = 7
+)
+
+// runConfigCommand run non-interactive config command, return exit code
+func runConfigCommand(nc nsConfigure, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, configUsage, os.Args[0], strings.Join(configKeys(), ","))
+		return configExitUsage
+	}
+	switch args[0] {
+	case "list":
+		return nc.listScopes()
+	case "get":
+		if len(args) < 2 || len(args) > 3 {
+			break
+		}
+		return nc.getScope(scopeName(args[1]), args[2:]...)
+	case "set":
+		if len(args) < 3 {
+			break
+		}
+		return nc.setScope(scopeName(args[1]), args[2:]...)
+	case "delete":
+		if len(args) != 2 {
+			break
+		}
+		return nc.deleteScope(scopeName(args[1]))
+	case "rename":
+		if len(args) != 3 {
+			break
+		}
+		return nc.renameScope(scopeName(args[1]), scopeName(args[2]))
+	case "encrypt", "decrypt":
+		if len(args) != 1 {
+			break
+		}
+		configEncrypted, configEncryptSet = args[0] == "encrypt", true
+		if configEncrypted {
+			if _, _, e := encryptionSecret(true); e != nil {
+				fmt.Fprintf(os.Stderr, "prepare encryption key failed %s\n", e.Error())
+				return configExitSave
+			}
+		}
+		if e := nc.save(); e != nil {
+			fmt.Fprintf(os.Stderr, "save configure failed %s\n", e.Error())
+			return configExitSave
+		}
+		return configExitOK
+	case "convert":
+		if len(args) != 3 {
+			break
+		}
+		if e := convertConfig(args[1], args[2]); e != nil {
+			fmt.Fprintf(os.Stderr, "convert configure failed %s\n", e.Error())
+			return configExitSave
+		}
+		return configExitOK
+	case "validate":
+		if len(args) != 1 {
+			break
+		}
+		problems, e := validateConfig(configFile)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e.Error())
+			return configExitInvalid
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			return configExitInvalid
+		}
+		fmt.Printf("%s is valid\n", configFile)
+		return configExitOK
+	case "test":
+		var names []string
+		for _, n := range args[1:] {
+			names = append(names, scopeName(n))
+		}
+		if !nc.testScopes(names...) {
+			return configExitInvalid
+		}
+		return configExitOK
+	case "help":
+		fmt.Printf(configUsage, os.Args[0], strings.Join(configKeys(), ","))
+		return configExitOK
+	}
+	fmt.Fprintf(os.Stderr, configUsage, os.Args[0], strings.Join(configKeys(), ","))
+	return configExitUsage
+}
+
+// scopeName map user input to section name
+func scopeName(s string) string {
+	if strings.EqualFold(s, "default") {
+		return ini.DefaultSection
+	}
+	return s
+}
+
+func (nc nsConfigure) listScopes() int {
+	names := make([]string, 0, len(nc))
+	for n := range nc {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Println(n)
+	}
+	return configExitOK
+}
+
+func (nc nsConfigure) getScope(scope string, keys ...string) int {
+	c := nc[scope]
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "scope %s not found\n", scope)
+		return configExitNotFound
+	}
+	if len(keys) == 0 {
+		keys = configKeys()
+	}
+	for _, k := range keys {
+		v, ok := c.get(k)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown key %s\n", k)
+			return configExitUsage
+		}
+		if v != "" && inSlice(secretKeys, k) && !showSecret {
+			v = "******"
+		}
+		if len(keys) == 1 {
+			fmt.Println(v)
+		} else {
+			fmt.Printf("%s=%s\n", k, v)
+		}
+	}
+	return configExitOK
+}
+
+func (nc nsConfigure) setScope(scope string, pairs ...string) int {
+	c := nc[scope]
+	if c == nil {
+		c = &configure{}
+	}
+	for _, p := range pairs {
+		i := strings.Index(p, "=")
+		if i < 1 {
+			fmt.Fprintf(os.Stderr, "invalid argument %s, <key>=<value> expected\n", p)
+			return configExitUsage
+		}
+		v := p[i+1:]
+		if p[:i] == "private_key_json" && v != "" {
+			var e error
+			if v, e = parsePrivateKeyJSON(v); e != nil {
+				fmt.Fprintln(os.Stderr, e.Error())
+				return configExitUsage
+			}
+		}
+		if e := c.set(p[:i], v); e != nil {
+			fmt.Fprintln(os.Stderr, e.Error())
+			return configExitUsage
+		}
+	}
+	nc[scope] = c
+	if e := nc.save(); e != nil {
+		fmt.Fprintf(os.Stderr, "save configure failed %s\n", e.Error())
+		return configExitSave
+	}
+	return configExitOK
+}
+
+// inheritedBy names of scopes which inherit scope directly
+func (nc nsConfigure) inheritedBy(scope string) []string {
+	var res []string
+	for n, c := range nc {
+		if c != nil && c.Inherits != "" && scopeName(c.Inherits) == scope {
+			res = append(res, n)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// deleteScope delete scope, scope inherited by others is kept since they would inherit nothing
+func (nc nsConfigure) deleteScope(scope string) int {
+	if nc[scope] == nil {
+		fmt.Fprintf(os.Stderr, "scope %s not found\n", scope)
+		return configExitNotFound
+	}
+	if users := nc.inheritedBy(scope); len(users) > 0 {
+		for i, n := range users {
+			users[i] = scopeLabel(n)
+		}
+		fmt.Fprintf(os.Stderr, "scope %s is inherited by %s, change their inherits first\n", scopeLabel(scope), strings.Join(users, ","))
+		return configExitUsage
+	}
+	delete(nc, scope)
+	if e := nc.save(); e != nil {
+		fmt.Fprintf(os.Stderr, "save configure failed %s\n", e.Error())
+		return configExitSave
+	}
+	return configExitOK
+}
+
+// renameScope rename scope, inherits of other scopes are rewritten to new name
+func (nc nsConfigure) renameScope(scope, to string) int {
+	if nc[scope] == nil {
+		fmt.Fprintf(os.Stderr, "scope %s not found\n", scope)
+		return configExitNotFound
+	}
+	if nc[to] != nil {
+		fmt.Fprintf(os.Stderr, "scope %s already exists\n", to)
+		return configExitUsage
+	}
+	// scopes inheriting old name follow the rename
+	for _, n := range nc.inheritedBy(scope) {
+		c := *nc[n]
+		c.Inherits = scopeLabel(to)
+		nc[n] = &c
+	}
+	nc[to] = nc[scope]
+	delete(nc, scope)
+	if e := nc.save(); e != nil {
+		fmt.Fprintf(os.Stderr, "save configure failed %s\n", e.Error())
+		return configExitSave
+	}
+	return configExitOK
+}
+
+// configKeys return all ini key names of configure
+func configKeys() []string {
+	var keys []string
+	t := reflect.TypeOf(configure{})
+	for i := 0; i < t.NumField(); i++ {
+		if k := iniKey(t.Field(i)); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func iniKey(f reflect.StructField) string {
+	tag := f.Tag.Get("ini")
+	if tag == "-" {
+		return ""
+	}
+	return strings.Split(tag, ",")[0]
+}
+
+// field return addressable field of configure by ini key name
+func (config *configure) field(key string) (reflect.Value, bool) {
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if iniKey(v.Type().Field(i)) == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func (config *configure) get(key string) (string, bool) {
+	f, ok := config.field(key)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(f.Interface()), true
+}
+
+func (config *configure) set(key, value string) error {
+	f, ok := config.field(key)
+	if !ok {
+		return fmt.Errorf("unknown key %s, available keys %s", key, strings.Join(configKeys(), ","))
+	}
+	switch key {
+	case "auth_type":
+		if value != "" && value != "basic" && value != "token" {
+			return fmt.Errorf("invalid auth_type %s, available options basic,token", value)
+		}
+	case "credential_type":
+		if value != "" && value != "hmac" && value != "private_key" {
+			return fmt.Errorf("invalid credential_type %s, available options hmac,private_key", value)
+		}
+	case "credential_created":
+		if _, e := time.Parse(time.RFC3339, value); value != "" && e != nil {
+			return fmt.Errorf("invalid credential_created %s, RFC3339 time expected", value)
+		}
+	case "rotate_after":
+		if _, e := time.ParseDuration(value); value != "" && e != nil {
+			return fmt.Errorf("invalid rotate_after %s, duration such like 720h expected", value)
+		}
+	case "provider":
+		if value != "" && value != "s3" {
+			return fmt.Errorf("invalid provider %s, only s3 supported", value)
+		}
+	}
+	if f.Kind() != reflect.String {
+		return fmt.Errorf("key %s is not editable", key)
+	}
+	f.SetString(value)
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// configFormat detect configure file format by extension, ini is used by default
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	}
+	return "ini"
+}
+
+// isConfigFile whether s looks like a configure file instead of scope name
+func isConfigFile(s string) bool {
+	switch strings.ToLower(filepath.Ext(s)) {
+	case ".ini", ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// decodeConfig read configure file into scope name => key => value,
+// yaml and json files are maps of scope name to keys, "default" is used as name of default scope,
+// numbers and booleans in them are accepted as values as well
+func decodeConfig(path string) (map[string]map[string]string, error) {
+	raw := make(map[string]map[string]string)
+	if configFormat(path) == "ini" {
+		cfg, err := ini.Load(path)
+		if err != nil {
+			return raw, fmt.Errorf("read config failed, please run " + os.Args[0] + " config")
+		}
+		for _, section := range cfg.Sections() {
+			raw[section.Name()] = section.KeysHash()
+		}
+		return raw, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return raw, fmt.Errorf("read config failed, please run " + os.Args[0] + " config")
+	}
+	values := make(map[string]map[string]interface{})
+	if configFormat(path) == "yaml" {
+		err = yaml.Unmarshal(b, &values)
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		err = dec.Decode(&values)
+	}
+	if err != nil {
+		return raw, fmt.Errorf("parse %s error %s", path, err.Error())
+	}
+	for name, kv := range values {
+		scope := make(map[string]string, len(kv))
+		for k, v := range kv {
+			s, ok := scalarString(v)
+			if !ok {
+				return raw, fmt.Errorf("parse %s error value of %s in scope %s is not a scalar", path, k, name)
+			}
+			scope[k] = s
+		}
+		raw[scopeName(name)] = scope
+	}
+	return raw, nil
+}
+
+// scalarString string form of scalar decoded from yaml or json
+func scalarString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// encodeConfig return writer which write configure in format of path, encrypted marker is written
+// when secrets are encrypted, unknown keys of scopes are written back as they are
+func encodeConfig(path string, nc nsConfigure, encrypted bool, unknown map[string]map[string]string) (func(w io.Writer) (int64, error), error) {
+	if configFormat(path) == "ini" {
+		cfg := ini.Empty()
+		cfg.Section(ini.DefaultSection).NewKey("version", strconv.Itoa(configVersion))
+		if encrypted {
+			cfg.Section(ini.DefaultSection).NewKey(encryptedKey, "true")
+		}
+		for k, c := range nc {
+			cc, e := cfg.NewSection(k)
+			if e != nil {
+				return nil, e
+			}
+			if e := cc.ReflectFrom(c); e != nil {
+				return nil, e
+			}
+			for uk, uv := range unknown[k] {
+				if _, e := cc.NewKey(uk, uv); e != nil {
+					return nil, e
+				}
+			}
+		}
+		return cfg.WriteTo, nil
+	}
+	raw := make(map[string]map[string]interface{})
+	for name, c := range nc {
+		kv := make(map[string]interface{})
+		for uk, uv := range unknown[name] {
+			kv[uk] = uv
+		}
+		for _, k := range configKeys() {
+			if v, _ := c.get(k); v != "" {
+				kv[k] = v
+			}
+		}
+		if name == ini.DefaultSection {
+			name = "default"
+		}
+		raw[name] = kv
+	}
+	if raw["default"] == nil {
+		raw["default"] = make(map[string]interface{})
+	}
+	raw["default"]["version"] = configVersion
+	if encrypted {
+		raw["default"][encryptedKey] = true
+	}
+	var b []byte
+	var err error
+	if configFormat(path) == "yaml" {
+		b, err = yaml.Marshal(raw)
+	} else {
+		b, err = json.MarshalIndent(raw, "", "  ")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b).WriteTo, nil
+}
+
+// convertConfig convert configure file between ini, yaml and json
+func convertConfig(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	nc, meta, err := readConfig(src)
+	if err != nil {
+		return err
+	}
+	if meta.encrypted {
+		for _, c := range nc {
+			if e := c.encryptSecrets(); e != nil {
+				return e
+			}
+		}
+	}
+	write, err := encodeConfig(dst, nc, meta.encrypted, meta.unknown)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(dst); dir != "" {
+		os.MkdirAll(dir, 0700)
+	}
+	return writeFileAtomic(dst, write)
+}
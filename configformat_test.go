@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestDecodeConfigScalars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"hcs.json": `{"default": {"version": 2, "user_name": "u"}, "remote-s3": {"region": "r", "bucket_name": "b", "x": true}}`,
+		"hcs.yaml": "default:\n  version: 2\n  user_name: u\nremote-s3:\n  region: r\n  bucket_name: b\n  x: true\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := decodeConfig(path)
+		if err != nil {
+			t.Errorf("%s: decodeConfig failed %v", name, err)
+			continue
+		}
+		if v := raw[ini.DefaultSection]["version"]; v != "2" {
+			t.Errorf("%s: version = %q, want 2", name, v)
+		}
+		if v := raw["remote-s3"]["x"]; v != "true" {
+			t.Errorf("%s: x = %q, want true", name, v)
+		}
+	}
+	path := filepath.Join(dir, "nested.json")
+	ioutil.WriteFile(path, []byte(`{"default": {"user_name": {"a": "b"}}}`), 0600)
+	if _, err := decodeConfig(path); err == nil {
+		t.Error("nested value accepted")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gopkg.in/ini.v1"
+)
+
+// testScopes test given scopes or all scopes when names is empty, return whether all checks passed
+func (nc nsConfigure) testScopes(names ...string) bool {
+	if len(names) == 0 {
+		for n := range nc {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+	}
+	passed := true
+	for _, n := range names {
+		if !nc.testScope(n) {
+			passed = false
+		}
+	}
+	return passed
+}
+
+// testScope check credentials of scope against remote service and print result of each check,
+// account scopes are checked by striketracker auth and AboutMe, remote scopes by HeadBucket and put/delete probe
+func (nc nsConfigure) testScope(name string) bool {
+	passed := true
+	report := func(check string, err error, detail string) bool {
+		if err != nil {
+			passed = false
+			fmt.Printf("[FAIL] %s: %s: %s\n", scopeLabel(name), check, err.Error())
+			return false
+		}
+		fmt.Printf("[PASS] %s: %s%s\n", scopeLabel(name), check, detail)
+		return true
+	}
+	if nc[name] == nil {
+		report("scope", fmt.Errorf("not found"), "")
+		return false
+	}
+	if strings.HasPrefix(name, "remote-") {
+		// remote scopes never inherit
+		rc := *nc[name]
+		if !report("secrets", rc.resolveSecrets(), "") {
+			return false
+		}
+		testRemote(&rc, report)
+		return passed
+	}
+	c, err := nc.resolve(name)
+	if !report("inherits", err, "") {
+		return false
+	}
+	if !report("secrets", c.resolveSecrets(), "") {
+		return false
+	}
+	if c.Token == "" && (c.Username == "" || c.Password == "") {
+		report("auth", fmt.Errorf("neither token nor user_name/password configured"), "")
+		return false
+	}
+	api := newAPI()
+	if !report("auth ("+authType(c)+")", authenticate(api, c), "") {
+		return false
+	}
+	u, err := api.AboutMe()
+	detail := ""
+	if err == nil && u == nil {
+		err = fmt.Errorf("empty user info returned")
+	} else if err == nil {
+		detail = fmt.Sprintf(" account %s(%s)", u.AccountName, u.AccountHash)
+	}
+	if !report("about me", err, detail) {
+		return false
+	}
+	if !accountHashPattern.MatchString(name) {
+		return passed
+	}
+	if _, err := api.GetGCSAccounts(name); !report("service_accounts of "+name, err, "") {
+		return false
+	}
+	if c.credentialID() != "" {
+		sa, _, err := credentialOwner(api, name, c)
+		detail = ""
+		if err == nil {
+			detail = " owned by service_account " + sa.Name
+		}
+		report("credential "+c.credentialID(), err, detail)
+	}
+	return passed
+}
+
+// testRemote check bucket is reachable and writable by a probe object which is deleted afterwards
+func testRemote(rc *configure, report func(check string, err error, detail string) bool) {
+	if rc.Provider != "" && rc.Provider != "s3" {
+		report("provider", fmt.Errorf("unsupported provider %s", rc.Provider), "")
+		return
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(rc.Region),
+		Credentials: credentials.NewStaticCredentials(rc.AccessKeyID, rc.SecretAccessKey, ""),
+	})
+	if !report("session", err, "") {
+		return
+	}
+	svc := s3.New(sess)
+	if _, err := svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(rc.BucketName)}); !report("head bucket "+rc.BucketName, err, "") {
+		return
+	}
+	key := fmt.Sprintf(".logdownloader-probe-%d", time.Now().Unix())
+	if _, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(rc.BucketName),
+		Key:    aws.String(key),
+		Body:   strings.NewReader("logdownloader probe"),
+	}); !report("put "+key, err, "") {
+		return
+	}
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(rc.BucketName), Key: aws.String(key)})
+	report("delete "+key, err, "")
+}
+
+// verifyScope test scope after it's collected by wizard, let user re-enter values until checks pass or user keep it
+func (nc nsConfigure) verifyScope(name string) {
+	for !nc.testScope(name) {
+		option := scanInput{
+			Placeholder: "Credential check failed, select option: ",
+			Minlength:   1,
+			Default:     "edit",
+			Options: []*inputOptions{
+				&inputOptions{Value: "edit", Label: "re-enter configure of " + scopeLabel(name)},
+				&inputOptions{Value: "keep", Label: "keep configure as it is"},
+			},
+		}.scan()
+		if option != "edit" {
+			return
+		}
+		if strings.HasPrefix(name, "remote-") {
+			nc[name].collectRemote()
+		} else {
+			nc[name].collect()
+		}
+	}
+}
+
+func authType(c *configure) string {
+	if c.AuthType == "token" {
+		return "token"
+	}
+	return "basic"
+}
+
+// scopeLabel display name of scope, reverse of scopeName
+func scopeLabel(name string) string {
+	if name == ini.DefaultSection {
+		return "default"
+	}
+	return name
+}
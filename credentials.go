@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bucloud/hwapi"
+)
+
+// retryAPI retry failed credential api call when it's transient, credentials are managed before downloads start
+// or between hosts, so it isn't bound to interruption
+func retryAPI(op string, fn func() error) error {
+	return retry(context.Background(), op, fn)
+}
+
+// getGCSAccounts list service accounts of account, retried
+func getGCSAccounts(api *hwapi.HWApi, accountHash string) (sa *hwapi.GCSAccounts, err error) {
+	err = retryAPI("get service_accounts of "+accountHash, func() (e error) {
+		sa, e = api.GetGCSAccounts(accountHash)
+		return e
+	})
+	return sa, err
+}
+
+// getGCSPrivateKeys list private keys of service account, retried
+func getGCSPrivateKeys(api *hwapi.HWApi, accountHash, serviceAccountID string) (keys *hwapi.GCSPrivateKeys, err error) {
+	err = retryAPI("get private_keys of "+serviceAccountID, func() (e error) {
+		keys, e = api.GetGCSPrivateKeys(accountHash, serviceAccountID)
+		return e
+	})
+	return keys, err
+}
+
+// getGCSHMacKeys list hmac keys of service account, retried
+func getGCSHMacKeys(api *hwapi.HWApi, accountHash, serviceAccountID string) (hmacs *hwapi.GCSHMacKeys, err error) {
+	err = retryAPI("get hmac_keys of "+serviceAccountID, func() (e error) {
+		hmacs, e = api.GetGCSHMacKeys(accountHash, serviceAccountID)
+		return e
+	})
+	return hmacs, err
+}
+
+// serviceAccount return first service account of account, create one if there is none
+func serviceAccount(api *hwapi.HWApi, accountHash string) (*hwapi.GCSAccount, error) {
+	logger.Debug().Str("account_hash", accountHash).Msg("try auto generate service_account")
+	sa, err := getGCSAccounts(api, accountHash)
+	if err == nil && len(sa.List) > 0 {
+		return sa.List[0], nil
+	}
+	// try create gcs account
+	var account *hwapi.GCSAccount
+	err = retryAPI("create service_account of "+accountHash, func() (e error) {
+		account, e = api.CreateGCSAccount(accountHash, "auto generate log account", "log_account")
+		return e
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create service_account failed %s", err.Error())
+	}
+	return account, nil
+}
+
+// generateCredential generate HMAC key or private key for account based on credentialType
+// new credential is not generated when more then keyLimit keys exist unless -force_generate provided
+func generateCredential(api *hwapi.HWApi, accountHash, credentialType string) (*configure, error) {
+	sa, err := serviceAccount(api, accountHash)
+	if err != nil {
+		return nil, err
+	}
+	switch credentialType {
+	case "private_key":
+		keys, err := getGCSPrivateKeys(api, accountHash, sa.ID)
+		if err == nil && len(keys.List) > keyLimit && !forceGenerate {
+			return nil, fmt.Errorf("private_key generate failed, %d keys exist, try create it manually", len(keys.List))
+		}
+	default:
+		hmacs, err := getGCSHMacKeys(api, accountHash, sa.ID)
+		if err == nil && len(hmacs.List) > keyLimit && !forceGenerate {
+			return nil, fmt.Errorf("hmac_key generate failed, %d keys exist, try create it manually", len(hmacs.List))
+		}
+	}
+	return createCredential(api, accountHash, sa, credentialType)
+}
+
+// createCredential create credential under service account, creation time is recorded
+func createCredential(api *hwapi.HWApi, accountHash string, sa *hwapi.GCSAccount, credentialType string) (*configure, error) {
+	created := time.Now().UTC().Format(time.RFC3339)
+	switch credentialType {
+	case "private_key":
+		logger.Debug().Str("account_hash", accountHash).Msg("try auto generate private_key")
+		var key *hwapi.GCSPrivateKey
+		err := retryAPI("create private_key of "+sa.Name, func() (e error) {
+			key, e = api.CreateGCSPrivateKey(accountHash, sa.ID)
+			return e
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create private_key for service_account %s failed %s", sa.Name, err.Error())
+		}
+		return &configure{CredentialType: credentialType, PrivateKeyJSON: key.PrivateKeyData, CredentialCreated: created}, nil
+	default:
+		logger.Debug().Str("account_hash", accountHash).Msg("try auto generate hmac_keys")
+		var hmac *hwapi.GCSHMacKey
+		err := retryAPI("create hmac_key of "+sa.Name, func() (e error) {
+			hmac, e = api.CreateGCSHMacKey(accountHash, sa.ID)
+			return e
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create hmac_key for service_account %s failed %s", sa.Name, err.Error())
+		}
+		return &configure{CredentialType: "hmac", AccessKeyID: hmac.AccessID, SecretAccessKey: hmac.Secret, CredentialCreated: created}, nil
+	}
+}
+
+// privateKeyID return private_key_id of base64 encoded private key json
+func privateKeyID(privateKeyJSON string) string {
+	b, err := base64.StdEncoding.DecodeString(privateKeyJSON)
+	if err != nil {
+		return ""
+	}
+	var key struct {
+		PrivateKeyID string `json:"private_key_id"`
+	}
+	json.Unmarshal(b, &key)
+	return key.PrivateKeyID
+}
+
+// credentialID return id of credential used by configure, access id for HMAC key, private_key_id for private key
+func (config *configure) credentialID() string {
+	if config.PrivateKeyJSON != "" && config.CredentialType != "hmac" {
+		return privateKeyID(config.PrivateKeyJSON)
+	}
+	return config.AccessKeyID
+}
+
+// hasCredential whether configure holds HMAC key or private key
+func (config *configure) hasCredential() bool {
+	return (config.AccessKeyID != "" && config.SecretAccessKey != "") || config.PrivateKeyJSON != ""
+}
+
+// needRotate whether generated credential is older than rotate_after
+func (config *configure) needRotate(rotateAfter string) bool {
+	d, err := time.ParseDuration(rotateAfter)
+	if err != nil || d <= 0 {
+		return false
+	}
+	created, err := time.Parse(time.RFC3339, config.CredentialCreated)
+	if err != nil {
+		// credential not generated by us, no idea of its age
+		return false
+	}
+	return time.Since(created) > d
+}
+
+// credentialOwner find service account which own credential of configure, id of the key is returned as well
+func credentialOwner(api *hwapi.HWApi, accountHash string, config *configure) (*hwapi.GCSAccount, string, error) {
+	id := config.credentialID()
+	if id == "" {
+		return nil, "", fmt.Errorf("no credential configured")
+	}
+	sa, err := getGCSAccounts(api, accountHash)
+	if err != nil {
+		return nil, "", fmt.Errorf("get service_accounts failed %s", err.Error())
+	}
+	for _, s := range sa.List {
+		if config.PrivateKeyJSON != "" && config.CredentialType != "hmac" {
+			keys, err := getGCSPrivateKeys(api, accountHash, s.ID)
+			if err != nil {
+				return nil, "", fmt.Errorf("get private_keys of service_account %s failed %s", s.Name, err.Error())
+			}
+			for _, k := range keys.List {
+				if k.ID == id {
+					return s, k.ID, nil
+				}
+			}
+			continue
+		}
+		hmacs, err := getGCSHMacKeys(api, accountHash, s.ID)
+		if err != nil {
+			return nil, "", fmt.Errorf("get hmac_keys of service_account %s failed %s", s.Name, err.Error())
+		}
+		for _, k := range hmacs.List {
+			if k.AccessID == id {
+				return s, k.ID, nil
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("credential %s not found in account", id)
+}
+
+// reloadCredentialScope replace scope holding credential of accountHash with the one on disk when
+// other process changed its credential since configure was loaded, return whether it's replaced.
+// lock of lockConfig must been held
+func (nc nsConfigure) reloadCredentialScope(accountHash, currentAccount string) (bool, error) {
+	name := nc.credentialScope(accountHash, currentAccount)
+	if name == "" || nc[name] == nil {
+		return false, nil
+	}
+	disk, _, err := readConfig(configFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if disk[name] == nil || disk[name].credentialID() == nc[name].credentialID() {
+		return false, nil
+	}
+	*nc[name] = *disk[name]
+	configSnapshot[name] = *disk[name]
+	return true, nil
+}
+
+// rotateCredential create new credential under the service account of current one,
+// update every scope using current credential and save, then revoke current credential.
+// It's done under configure lock against configure on disk, credential rotated by other process
+// sharing configure is picked up instead, and then rotated only when rotateAfter is empty or it's expired as well.
+// cfgMu is taken only while Cfg is read or changed
+func rotateCredential(api *hwapi.HWApi, accountHash, currentAccount, rotateAfter string) error {
+	unlock, err := lockConfig()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	cfgMu.Lock()
+	reloaded, err := Cfg.reloadCredentialScope(accountHash, currentAccount)
+	if err != nil {
+		cfgMu.Unlock()
+		return fmt.Errorf("reload configure failed %s", err.Error())
+	} else if reloaded {
+		logger.Info().Str("account_hash", accountHash).Msg("credential rotated by other process picked up")
+	}
+	current, err := Cfg.accountConfigure(accountHash, currentAccount)
+	cfgMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if rotateAfter != "" && !current.needRotate(rotateAfter) {
+		return nil
+	}
+	old := current.credentialID()
+	sa, oldKeyID, err := credentialOwner(api, accountHash, current)
+	if err != nil {
+		return err
+	}
+	credentialType := "hmac"
+	if current.PrivateKeyJSON != "" && current.CredentialType != "hmac" {
+		credentialType = "private_key"
+	}
+	cred, err := createCredential(api, accountHash, sa, credentialType)
+	if err != nil {
+		return err
+	}
+	cfgMu.Lock()
+	for _, c := range Cfg {
+		if c == nil || c.credentialID() != old {
+			continue
+		}
+		c.copyCredential(cred)
+	}
+	err = Cfg.saveLocked()
+	cfgMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("save configure failed %s, new credential %s kept, old one not revoked", err.Error(), cred.credentialID())
+	}
+	logger.Info().Str("account_hash", accountHash).Str("credential_id", cred.credentialID()).Msg("new credential saved")
+	err = retryAPI("revoke credential "+old, func() (e error) {
+		if credentialType == "private_key" {
+			_, e = api.DeleteGCSPrivateKey(accountHash, sa.ID, oldKeyID)
+		} else {
+			_, e = api.DeleteGCSHMacKey(accountHash, sa.ID, oldKeyID)
+		}
+		return e
+	})
+	if err != nil {
+		return fmt.Errorf("revoke credential %s failed %s", old, err.Error())
+	}
+	logger.Info().Str("account_hash", accountHash).Str("credential_id", old).Msg("old credential revoked")
+	return nil
+}
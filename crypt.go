@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// encrypted value looks like enc:{source}:{base64(salt+nonce+ciphertext)}
+const (
+	encPrefix         = "enc:"
+	encSourceKeyfile  = "keyfile"
+	encSourcePassword = "passphrase"
+	encSaltSize       = 16
+	encIterations     = 100000
+)
+
+var (
+	// keyFile local keyfile used to encrypt secrets when HW_CONFIG_PASSPHRASE is absent
+	keyFile string = homeDir(".highwinds", "hcs.key")
+	// configEncrypted secrets would been encrypted when save configure
+	configEncrypted bool = false
+	// configEncryptSet set by config encrypt/decrypt, otherwise save follows the marker of file on disk
+	configEncryptSet bool = false
+)
+
+// encryptedKey marker of default scope written next to version, secrets are encrypted on save while it's true
+const encryptedKey = "encrypted"
+
+// takeEncryptedMarker remove marker from raw configure and return its value
+func takeEncryptedMarker(raw map[string]map[string]string) (bool, error) {
+	d := raw[ini.DefaultSection]
+	v, ok := d[encryptedKey]
+	if !ok {
+		return false, nil
+	}
+	delete(d, encryptedKey)
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %s, true or false expected", encryptedKey, v)
+	}
+	return b, nil
+}
+
+// encryptSecrets encrypt all secret fields of configure in place
+func (config *configure) encryptSecrets() error {
+	for _, k := range secretKeys {
+		v, _ := config.get(k)
+		if v == "" || strings.HasPrefix(v, encPrefix) {
+			continue
+		}
+		ev, e := encryptValue(v)
+		if e != nil {
+			return e
+		}
+		config.set(k, ev)
+	}
+	return nil
+}
+
+func encryptValue(plain string) (string, error) {
+	source, secret, err := encryptionSecret(true)
+	if err != nil {
+		return "", err
+	}
+	salt := make([]byte, encSaltSize)
+	if _, e := io.ReadFull(rand.Reader, salt); e != nil {
+		return "", e
+	}
+	gcm, err := newGCM(secret, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, e := io.ReadFull(rand.Reader, nonce); e != nil {
+		return "", e
+	}
+	data := append(salt, nonce...)
+	data = gcm.Seal(data, nonce, []byte(plain), nil)
+	return encPrefix + source + ":" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+func decryptValue(v string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(v, encPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	var secret []byte
+	var err error
+	switch parts[0] {
+	case encSourcePassword:
+		if secret = []byte(os.Getenv("HW_CONFIG_PASSPHRASE")); len(secret) == 0 {
+			return "", fmt.Errorf("value encrypted by passphrase, please set HW_CONFIG_PASSPHRASE")
+		}
+	case encSourceKeyfile:
+		if secret, err = ioutil.ReadFile(keyFile); err != nil {
+			return "", fmt.Errorf("value encrypted by keyfile, read %s failed %s", keyFile, err.Error())
+		}
+	default:
+		return "", fmt.Errorf("unknown key source %s", parts[0])
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	if len(data) < encSaltSize {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	gcm, err := newGCM(secret, data[:encSaltSize])
+	if err != nil {
+		return "", err
+	}
+	data = data[encSaltSize:]
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("wrong key or corrupted value")
+	}
+	return string(plain), nil
+}
+
+// encryptionSecret prefer passphrase from HW_CONFIG_PASSPHRASE, fallback to local keyfile
+func encryptionSecret(create bool) (string, []byte, error) {
+	if p := os.Getenv("HW_CONFIG_PASSPHRASE"); p != "" {
+		return encSourcePassword, []byte(p), nil
+	}
+	b, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		return encSourceKeyfile, b, nil
+	}
+	if !os.IsNotExist(err) || !create {
+		return "", nil, err
+	}
+	b = make([]byte, 32)
+	if _, e := io.ReadFull(rand.Reader, b); e != nil {
+		return "", nil, e
+	}
+	os.MkdirAll(filepath.Dir(keyFile), 0700)
+	if e := ioutil.WriteFile(keyFile, b, 0600); e != nil {
+		return "", nil, e
+	}
+	return encSourceKeyfile, b, nil
+}
+
+func newGCM(secret, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2SHA256(secret, salt, encIterations))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2SHA256 derive 32 bytes key, only one block of PBKDF2 is needed
+func pbkdf2SHA256(password, salt []byte, iter int) []byte {
+	prf := hmac.New(sha256.New, password)
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, 1)
+	prf.Write(salt)
+	prf.Write(buf)
+	u := prf.Sum(nil)
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iter; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
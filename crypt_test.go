@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914 section 11, only the first 32 bytes are derived
+	cases := []struct {
+		password, salt string
+		iter           int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	}
+	for _, c := range cases {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(c.password), []byte(c.salt), c.iter))
+		if got != c.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", c.password, c.salt, c.iter, got, c.want)
+		}
+	}
+}
+
+func TestEncryptValue(t *testing.T) {
+	os.Setenv("HW_CONFIG_PASSPHRASE", "test passphrase")
+	defer os.Unsetenv("HW_CONFIG_PASSPHRASE")
+	ev, err := encryptValue("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ev, encPrefix+encSourcePassword+":") {
+		t.Fatalf("unexpected encrypted value %s", ev)
+	}
+	if v, err := decryptValue(ev); err != nil || v != "secret" {
+		t.Fatalf("decryptValue = %q, %v, want secret", v, err)
+	}
+	os.Setenv("HW_CONFIG_PASSPHRASE", "other passphrase")
+	if _, err := decryptValue(ev); err == nil {
+		t.Fatal("decrypt with wrong passphrase succeeded")
+	}
+	if _, err := decryptValue(encPrefix + "unknown:AAAA"); err == nil {
+		t.Fatal("decrypt with unknown source succeeded")
+	}
+}
+
+// useTempConfig point configFile and keyFile to temp dir with content, globals are restored by returned func
+func useTempConfig(t *testing.T, content string) func() {
+	dir, err := ioutil.TempDir("", "hcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfig, oldKey, oldEnc, oldSet, oldSnap := configFile, keyFile, configEncrypted, configEncryptSet, configSnapshot
+	configFile, keyFile = filepath.Join(dir, "hcs.ini"), filepath.Join(dir, "hcs.key")
+	configEncrypted, configEncryptSet, configSnapshot = false, false, make(map[string]configure)
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		configFile, keyFile, configEncrypted, configEncryptSet, configSnapshot = oldConfig, oldKey, oldEnc, oldSet, oldSnap
+		os.RemoveAll(dir)
+	}
+}
+
+// savedValue raw value of key in configure file
+func savedValue(t *testing.T, scope, key string) string {
+	raw, err := decodeConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw[scope][key]
+}
+
+func TestEncryptedMarker(t *testing.T) {
+	defer useTempConfig(t, "version = 2\nuser_name = u\n")()
+	// config encrypt on file without secrets
+	nc, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := runConfigCommand(nc, []string{"encrypt"}); code != configExitOK {
+		t.Fatalf("config encrypt = %d", code)
+	}
+	if v := savedValue(t, ini.DefaultSection, encryptedKey); v != "true" {
+		t.Fatalf("encrypted marker = %q, want true", v)
+	}
+	// next process sets a secret
+	configEncrypted, configEncryptSet = false, false
+	if nc, err = loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if code := runConfigCommand(nc, []string{"set", "default", "token=abc"}); code != configExitOK {
+		t.Fatalf("config set = %d", code)
+	}
+	if v := savedValue(t, ini.DefaultSection, "token"); !strings.HasPrefix(v, encPrefix) {
+		t.Fatalf("token saved as %q, want encrypted", v)
+	}
+	if nc, err = loadConfig(); err != nil || nc[ini.DefaultSection].Token != "abc" {
+		t.Fatalf("token loaded as %v, %v, want abc", nc[ini.DefaultSection], err)
+	}
+}
+
+func TestSaveFollowsEncryptionOnDisk(t *testing.T) {
+	defer useTempConfig(t, "version = 2\nuser_name = u\npassword = p\n")()
+	nc, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other process encrypts file after this one loaded it
+	disk, meta, err := readConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range disk {
+		if e := c.encryptSecrets(); e != nil {
+			t.Fatal(e)
+		}
+	}
+	write, err := encodeConfig(configFile, disk, true, meta.unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(configFile, write); err != nil {
+		t.Fatal(err)
+	}
+	nc["a1b2c3d4"] = &configure{Token: "t"}
+	if err := nc.save(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"password", "a1b2c3d4.token"} {
+		scope, key := ini.DefaultSection, k
+		if i := strings.Index(k, "."); i > 0 {
+			scope, key = k[:i], k[i+1:]
+		}
+		if v := savedValue(t, scope, key); !strings.HasPrefix(v, encPrefix) {
+			t.Errorf("%s saved as %q, want encrypted", k, v)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/bucloud/hwapi"
+)
+
+// remoteUploader uploader of remote output, set by setupOutput when output is {remoteConfigName}:{prefix}
+var remoteUploader *s3manager.Uploader
+
+// hcsStorageURL prefix of relative urls returned by SearchLogs, same one hwapi's downloader uses
+const hcsStorageURL = "https://hcs.hwcdn.net/v1/AUTH_hwcdn-logstore"
+
+// stateSaveInterval completed files are saved to disk at most this often, after each host/type pair
+// and before the process exits on second signal
+var stateSaveInterval = 5 * time.Second
+
+var (
+	openedStateMu sync.Mutex
+	// openedStateValue state of running download, saved by signal handler before exiting immediately
+	openedStateValue *downloadState
+)
+
+func setOpenedState(st *downloadState) {
+	openedStateMu.Lock()
+	defer openedStateMu.Unlock()
+	openedStateValue = st
+}
+
+func openedState() *downloadState {
+	openedStateMu.Lock()
+	defer openedStateMu.Unlock()
+	return openedStateValue
+}
+
+// downloadState completed files, kept in the same fastcache file under -c as hwapi's downloader does,
+// so state of previous versions is still used and it never grows beyond -cs (oldest entries are evicted)
+type downloadState struct {
+	mu    sync.Mutex
+	dir   string
+	cache *fastcache.Cache
+	saved time.Time
+	dirty bool
+}
+
+// fileState value of state entry, same as hwapi's downState, State 1 means completed
+type fileState struct {
+	StartedDate time.Time
+	EndedDate   time.Time
+	State       int
+	Size        string
+}
+
+// openState load state saved in dir, fastcache owns dir and replaces it on every save;
+// existing state keeps the size it's created with, since fastcache drops state loaded with another size
+func openState(dir string) (*downloadState, error) {
+	if err := os.MkdirAll(filepath.Dir(filepath.Clean(dir)), 0755); err != nil {
+		return nil, err
+	}
+	cache, err := fastcache.LoadFromFile(dir)
+	if err != nil {
+		if _, e := os.Stat(dir); e == nil {
+			logger.Debug().Err(err).Str("state_dir", dir).Msg("state unreadable, start with empty state")
+		}
+		cache = fastcache.New(stateSize)
+	}
+	return &downloadState{dir: dir, cache: cache, saved: time.Now()}, nil
+}
+
+func (st *downloadState) has(key string) bool {
+	fs := &fileState{}
+	b := st.cache.Get(nil, []byte(key))
+	return len(b) > 0 && json.Unmarshal(b, fs) == nil && fs.State == 1
+}
+
+// add record key as completed, state is saved once stateSaveInterval passed since last save
+func (st *downloadState) add(key string, rec *fileRecord, started time.Time) error {
+	b, err := json.Marshal(&fileState{StartedDate: started, EndedDate: time.Now().UTC(), State: 1, Size: strconv.FormatInt(rec.Size, 10)})
+	if err != nil {
+		return err
+	}
+	st.cache.Set([]byte(key), b)
+	st.mu.Lock()
+	st.dirty = true
+	due := time.Since(st.saved) >= stateSaveInterval
+	st.mu.Unlock()
+	if due {
+		return st.save()
+	}
+	return nil
+}
+
+// save write state to disk when anything is added since last save
+func (st *downloadState) save() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.dirty {
+		return nil
+	}
+	st.dirty, st.saved = false, time.Now()
+	if err := st.cache.SaveToFile(st.dir); err != nil {
+		st.dirty = true
+		return err
+	}
+	return nil
+}
+
+func (st *downloadState) close() error {
+	err := st.save()
+	st.cache.Reset()
+	return err
+}
+
+// stateKey key of file in state, md5 of url path as hwapi's downloader uses,
+// query of signed url is dropped since it changes between searches
+func stateKey(rawurl string) string {
+	p := fileURL(rawurl)
+	if u, err := url.Parse(p); err == nil {
+		p = u.Path
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(p)))
+}
+
+// fileURL absolute url of file, relative urls are in HCS storage
+func fileURL(rawurl string) string {
+	rawurl = strings.Trim(rawurl, "\r")
+	if !strings.HasPrefix(rawurl, "http") {
+		return hcsStorageURL + "/" + rawurl
+	}
+	return rawurl
+}
+
+// manifestDir manifests are kept next to state dir since fastcache replaces the whole state dir on save
+func manifestDir() string {
+	return filepath.Clean(stateDir) + ".manifests"
+}
+
+// fileStallTimeout file request is aborted when neither response header nor body data arrives in time
+var fileStallTimeout = 2 * time.Minute
+
+// fileClient client of log files, it shares transport with hwapi so dial/TLS timeouts and connection limits apply
+var fileClient = &http.Client{Transport: transport}
+
+// stallError file request aborted by fileStallTimeout, it's a timeout net.Error so it's retried
+type stallError struct{}
+
+func (stallError) Error() string   { return "no data received in " + fileStallTimeout.String() }
+func (stallError) Timeout() bool   { return true }
+func (stallError) Temporary() bool { return true }
+
+// stallBody body of file response, every read pushes the deadline back
+type stallBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	stalled *int32
+	cancel  context.CancelFunc
+}
+
+func (b *stallBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if atomic.LoadInt32(b.stalled) == 1 {
+		return n, stallError{}
+	}
+	b.timer.Reset(fileStallTimeout)
+	return n, err
+}
+
+func (b *stallBody) Close() error {
+	b.timer.Stop()
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// newFileRequest GET request of file, HCS urls are authenticated by log token of api like hwapi does
+func newFileRequest(ctx context.Context, api *hwapi.HWApi, rawurl string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, fileURL(rawurl), nil)
+	if err != nil {
+		return nil, err
+	}
+	if api != nil && api.AuthToken != nil && api.AuthToken.LogTokens != "" && strings.Contains(req.URL.Host, "hcs.hwcdn") {
+		req.Header.Set("X-Auth-Token", api.AuthToken.LogTokens)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// getFile send file request by fileClient, request is aborted once it stalls for fileStallTimeout
+func getFile(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	var stalled int32
+	timer := time.AfterFunc(fileStallTimeout, func() {
+		atomic.StoreInt32(&stalled, 1)
+		cancel()
+	})
+	resp, err := fileClient.Do(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		cancel()
+		if atomic.LoadInt32(&stalled) == 1 {
+			return nil, stallError{}
+		}
+		return nil, err
+	}
+	resp.Body = &stallBody{ReadCloser: resp.Body, timer: timer, stalled: &stalled, cancel: cancel}
+	return resp, nil
+}
+
+// downloadResult result of downloading files of one host/type pair
+type downloadResult struct {
+	Downloaded int
+	Skipped    int
+	Failed     int
+}
+
+// downloader download files of hosts being handled concurrently through one pool of -n workers
+type downloader struct {
+	api  *hwapi.HWApi
+	st   *downloadState
+	mf   *manifest
+	pool *filePool
+}
+
+func (d *downloader) close() {
+	d.pool.close()
+	d.mf.close()
+}
+
+// filePool fixed number of workers shared by all hosts, so -n bounds files downloaded at a time
+type filePool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+func newFilePool(n int) *filePool {
+	if n < 1 {
+		n = 1
+	}
+	p := &filePool{jobs: make(chan func())}
+	for i := 0; i < n; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// submit hand job to a free worker, false when ctx is cancelled before any worker takes it
+func (p *filePool) submit(ctx context.Context, job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *filePool) close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// fetchFiles download urls into dir by shared pool, files recorded in state are skipped,
+// files fail verification are fetched again up to -verify_retries times and verified ones are added to manifest;
+// when ctx is cancelled no more files are started and in-flight files are aborted
+func (d *downloader) fetchFiles(ctx context.Context, dir string, h *hwapi.HostName, t string, urls []string) (*downloadResult, error) {
+	res := &downloadResult{}
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		lastErr error
+	)
+	fetch := func(u string) {
+		defer wg.Done()
+		var rec *fileRecord
+		started := time.Now().UTC()
+		fetch := func() (e error) {
+			rec, e = fetchFile(ctx, d.api, dir, u)
+			return e
+		}
+		err := retry(ctx, "fetch "+fileName(u), fetch)
+		for attempt := 1; attempt <= verifyRetries && isVerifyError(err) && ctx.Err() == nil; attempt++ {
+			logger.Warn().Err(err).Str("host", h.Name+"("+h.HostHash+")").Str("file", fileName(u)).Int("attempt", attempt).Msg("fetch file again")
+			err = retry(ctx, "fetch "+fileName(u), fetch)
+		}
+		if err == nil {
+			rec.HostHash, rec.Type, rec.File, rec.VerifiedAt = h.HostHash, t, fileName(u), time.Now().UTC()
+			if e := d.mf.add(rec); e != nil {
+				logger.Warn().Err(e).Str("manifest", d.mf.path).Msg("write manifest failed")
+			}
+			err = d.st.add(stateKey(u), rec, started)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error().Err(err).Str("host", h.Name+"("+h.HostHash+")").Str("file", fileName(u)).Msg("download file failed")
+				res.Failed++
+				lastErr = err
+			}
+		} else {
+			logger.Debug().Str("host", h.Name+"("+h.HostHash+")").Str("file", fileName(u)).Msg("file downloaded")
+			res.Downloaded++
+		}
+	}
+	for _, u := range urls {
+		if d.st.has(stateKey(u)) {
+			res.Skipped++
+			continue
+		}
+		u := u
+		wg.Add(1)
+		if !d.pool.submit(ctx, func() { fetch(u) }) {
+			wg.Done()
+			break
+		}
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return res, ctx.Err()
+	}
+	if lastErr != nil {
+		return res, fmt.Errorf("%d files failed, last error %s", res.Failed, lastErr.Error())
+	}
+	return res, nil
+}
+
+// datePathPattern YYYY/MM/DD/{file} at the end of raw log url path
+var datePathPattern = regexp.MustCompile(`[0-9]{4}/[0-9]{2}/[0-9]{2}/[^/]+$`)
+
+// fileTarget where url is stored under local dir or {remoteConfigName}:{bucket}:{prefix}, result is in the same form;
+// files are kept in YYYY/MM/DD/ dirs of their url on remote storage and in default -d as hwapi's downloader does
+func fileTarget(dir, rawurl string) string {
+	name := fileName(rawurl)
+	if u, err := url.Parse(fileURL(rawurl)); err == nil {
+		if p := datePathPattern.FindString(u.Path); p != "" {
+			name = p
+		}
+	}
+	if parts := strings.SplitN(dir, ":", 3); len(parts) == 3 {
+		return parts[0] + ":" + parts[1] + ":" + strings.TrimLeft(path.Join(parts[2], name), "/")
+	}
+	if output != "" && output != "." && output != "./" {
+		name = fileName(rawurl)
+	}
+	return filepath.Join(dir, filepath.FromSlash(name))
+}
+
+// fetchFile download url into local dir or {remoteConfigName}:{bucket}:{prefix}, local file is written
+// to .part file first and renamed once completed and verified, so aborted files never look complete
+func fetchFile(ctx context.Context, api *hwapi.HWApi, dir, rawurl string) (*fileRecord, error) {
+	target := fileTarget(dir, rawurl)
+	if parts := strings.SplitN(target, ":", 3); len(parts) == 3 && remoteUploader != nil {
+		return uploadFile(ctx, api, parts[1], parts[2], rawurl)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	return fetchPart(ctx, api, target, rawurl)
+}
+
+// uploadFile stream url to remote bucket and verify streamed data, upload can't been resumed so it always starts from zero
+func uploadFile(ctx context.Context, api *hwapi.HWApi, bucket, key, rawurl string) (*fileRecord, error) {
+	req, err := newFileRequest(ctx, api, rawurl)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := getFile(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{resp.StatusCode, resp.Status}
+	}
+	v := newVerifier(key)
+	_, err = remoteUploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   io.TeeReader(resp.Body, v),
+	})
+	if err != nil {
+		v.abort()
+		return nil, err
+	}
+	// uploaded object with bad checksum is overwritten by next attempt
+	rec, err := v.check(parseObjectHash(resp.Header))
+	if err != nil {
+		return nil, err
+	}
+	rec.Target = bucket + "/" + key
+	return rec, nil
+}
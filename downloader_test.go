@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFileTarget(t *testing.T) {
+	defer func(o string) { output = o }(output)
+	gcs := "https://storage.googleapis.com/bucket/a1a1a1a1/cds/2026/03/01/x_00.log.gz?X-Goog-Signature=abc"
+	hcs := "a1a1a1a1/2020/12/31/x_23.log.gz"
+	cases := []struct {
+		output, dir, rawurl, want string
+	}{
+		// default -d keeps date dirs as hwapi did
+		{"./", "./", gcs, filepath.Join("2026", "03", "01", "x_00.log.gz")},
+		{"./", "./", hcs, filepath.Join("2020", "12", "31", "x_23.log.gz")},
+		{"./", "cds/", gcs, filepath.Join("cds", "2026", "03", "01", "x_00.log.gz")},
+		{"", "", gcs, filepath.Join("2026", "03", "01", "x_00.log.gz")},
+		// custom -d is flat
+		{"/data/logs", "/data/logs", gcs, filepath.Join("/data/logs", "x_00.log.gz")},
+		{"/data/logs", "/data/logs/cdi/", hcs, filepath.Join("/data/logs/cdi", "x_23.log.gz")},
+		{"./", "./", "https://example.com/flat/x.log.gz", "x.log.gz"},
+		// remote keys always keep date dirs
+		{"s3:logs", "s3:bucket:logs/www.example.com/", gcs, "s3:bucket:logs/www.example.com/2026/03/01/x_00.log.gz"},
+		{"s3:", "s3:bucket:/www.example.com/cds/", hcs, "s3:bucket:www.example.com/cds/2020/12/31/x_23.log.gz"},
+	}
+	for _, c := range cases {
+		output = c.output
+		if got := fileTarget(c.dir, c.rawurl); got != c.want {
+			t.Errorf("fileTarget(%q, %q) with -d %q = %q, want %q", c.dir, c.rawurl, c.output, got, c.want)
+		}
+	}
+}
+
+func TestFilePool(t *testing.T) {
+	p := newFilePool(2)
+	var (
+		mu                 sync.Mutex
+		running, max, runs int
+	)
+	started := make(chan struct{}, 6)
+	release := make(chan struct{})
+	job := func() {
+		mu.Lock()
+		running++
+		runs++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+	for i := 0; i < 2; i++ {
+		if !p.submit(context.Background(), job) {
+			t.Fatal("submit to free worker failed")
+		}
+	}
+	<-started
+	<-started
+	// both workers are busy, cancelled submit gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if p.submit(ctx, func() { t.Error("job submitted after cancel ran") }) {
+		t.Error("submit after cancel = true, want false")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.submit(context.Background(), job)
+		}()
+	}
+	close(release)
+	wg.Wait()
+	p.close()
+	if runs != 6 || max != 2 {
+		t.Errorf("%d jobs ran, at most %d at a time, want 6 and 2", runs, max)
+	}
+}
@@ -5,7 +5,7 @@ go 1.14
 require (
 	cloud.google.com/go v0.74.0
 	cloud.google.com/go/storage v1.12.0
-	github.com/VictoriaMetrics/fastcache v1.5.7 // indirect
+	github.com/VictoriaMetrics/fastcache v1.5.7
 	github.com/aws/aws-sdk-go v1.36.15
 	github.com/bucloud/hwapi v0.3.13
 	github.com/magiconair/properties v1.8.1
@@ -13,4 +13,5 @@ require (
 	golang.org/x/oauth2 v0.0.0-20201208152858-08078c50e5b5
 	google.golang.org/api v0.36.0
 	gopkg.in/ini.v1 v1.56.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/bucloud/hwapi"
+)
+
+var (
+	// hostExclude comma separated wildcards of hosts to skip
+	hostExclude string = ""
+	// hostRegex comma separated regular expressions of hosts to use
+	hostRegex string = ""
+	// hostExcludeRegex comma separated regular expressions of hosts to skip
+	hostExcludeRegex string = ""
+	// hostAccounts comma separated account hashes hosts must belong to
+	hostAccounts string = ""
+)
+
+// hostFilter client side filter of hosts, wildcards and regular expressions match host name or hosthash
+type hostFilter struct {
+	include   []string
+	exclude   []string
+	includeRe []*regexp.Regexp
+	excludeRe []*regexp.Regexp
+	accounts  []string
+}
+
+func hostFilterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&hostExclude, "exclude", hostExclude, "skip hosts match wildcard, use comma to split multiple patterns")
+	fs.StringVar(&hostRegex, "regex", hostRegex, "use hosts whose name or hosthash match regular expression, use comma to split multiple expressions")
+	fs.StringVar(&hostExcludeRegex, "exclude_regex", hostExcludeRegex, "skip hosts whose name or hosthash match regular expression, use comma to split multiple expressions")
+	fs.StringVar(&hostAccounts, "account", hostAccounts, "only use hosts of account hash, sub-accounts are searched directly, use comma to split multiple account hashes")
+}
+
+// hostSelected whether any flag selecting hosts provided
+func hostSelected() bool {
+	return hosthashs != "" || hostPattern != "" || hostRegex != "" || hostAccounts != ""
+}
+
+// splitList split comma separated value, empty items are dropped
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func compileList(s string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, v := range splitList(s) {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %s", err.Error())
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// wildcard lower case pattern, pattern without wildcard matches as sub string as api search does
+func wildcard(p string) (string, error) {
+	p = strings.ToLower(p)
+	if !strings.ContainsAny(p, "*?[") {
+		p = "*" + p + "*"
+	}
+	if _, err := path.Match(p, ""); err != nil {
+		return "", fmt.Errorf("invalid wildcard %s", p)
+	}
+	return p, nil
+}
+
+// newHostFilter build filter from -pattern, -exclude, -regex, -exclude_regex and -account
+func newHostFilter() (*hostFilter, error) {
+	f := &hostFilter{accounts: splitList(hostAccounts)}
+	var err error
+	for _, p := range splitList(hostPattern) {
+		w, e := wildcard(p)
+		if e != nil {
+			return nil, e
+		}
+		f.include = append(f.include, w)
+	}
+	for _, p := range splitList(hostExclude) {
+		w, e := wildcard(p)
+		if e != nil {
+			return nil, e
+		}
+		f.exclude = append(f.exclude, w)
+	}
+	if f.includeRe, err = compileList(hostRegex); err != nil {
+		return nil, err
+	}
+	if f.excludeRe, err = compileList(hostExcludeRegex); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func matchWildcards(patterns []string, h *hwapi.HostName) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, strings.ToLower(h.Name)); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, strings.ToLower(h.HostHash)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRegexps(list []*regexp.Regexp, h *hwapi.HostName) bool {
+	for _, re := range list {
+		if re.MatchString(h.Name) || re.MatchString(h.HostHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// match whether host is selected, it should match any include pattern when there is one,
+// belong to one of accounts when provided and match none of exclude patterns
+func (f *hostFilter) match(h *hwapi.HostName) bool {
+	if len(f.accounts) > 0 && !inSlice(f.accounts, h.AccountHash) {
+		return false
+	}
+	if (len(f.include) > 0 || len(f.includeRe) > 0) && !matchWildcards(f.include, h) && !matchRegexps(f.includeRe, h) {
+		return false
+	}
+	return !matchWildcards(f.exclude, h) && !matchRegexps(f.excludeRe, h)
+}
+
+// filter return selected hosts, deduped by hosthash
+func (f *hostFilter) filter(hosts []*hwapi.HostName) []*hwapi.HostName {
+	seen := make(map[string]bool)
+	var res []*hwapi.HostName
+	for _, h := range hosts {
+		if h == nil || seen[h.HostHash] || !f.match(h) {
+			continue
+		}
+		seen[h.HostHash] = true
+		res = append(res, h)
+	}
+	return res
+}
+
+// searchHosts search hosts by every -pattern in every -account (current account when absent) then filter them,
+// * is searched when only regular expressions or accounts provided
+func searchHosts(api *hwapi.HWApi, cu *hwapi.User) ([]*hwapi.HostName, error) {
+	f, err := newHostFilter()
+	if err != nil {
+		return nil, err
+	}
+	keys := splitList(hostPattern)
+	if len(keys) == 0 {
+		keys = []string{"*"}
+	}
+	accounts := f.accounts
+	if len(accounts) == 0 {
+		accounts = []string{cu.AccountHash}
+	}
+	var found []*hwapi.HostName
+	for _, acc := range accounts {
+		for _, key := range keys {
+			logger.Info().Str("account_hash", acc).Str("search_key", key).Msg("search hosts by pattern")
+			r, truncated, err := searchAll(api, acc, key)
+			if err != nil {
+				return nil, fmt.Errorf("search hosts %s in account %s failed %s", key, acc, err.Error())
+			}
+			if truncated {
+				logger.Error().Str("account_hash", acc).Str("search_key", key).Int("results", len(r)).Msg("search results truncated, some hosts are missed, raise -max or narrow pattern")
+			}
+			found = append(found, r...)
+		}
+	}
+	hosts := f.filter(found)
+	logger.Info().Int("found", len(found)).Int("selected", len(hosts)).Msg("hosts filtered")
+	return hosts, nil
+}
+
+// search limits, api has no offset, so limit is raised until all results are returned
+const (
+	searchPageSize = 100
+	searchLimit    = 10000
+)
+
+// searchAll search hosts of account by key, limit is raised until results are less than it,
+// positive -max caps results, truncated reports whether more results may exist. Transient failures are retried,
+// searching runs before downloads start so it isn't bound to interruption
+func searchAll(api *hwapi.HWApi, acc, key string) ([]*hwapi.HostName, bool, error) {
+	limit := searchLimit
+	if maxResult > 0 && maxResult < limit {
+		limit = maxResult
+	}
+	for size := searchPageSize; ; size *= 4 {
+		if size > limit {
+			size = limit
+		}
+		var r *hwapi.SearchResult
+		err := retry(context.Background(), "search hosts "+key+" in account "+acc, func() (e error) {
+			r, e = api.Search(acc, key, size)
+			return e
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if len(r.Hostnames) < size {
+			return r.Hostnames, false, nil
+		}
+		if size == limit {
+			return r.Hostnames, true, nil
+		}
+		logger.Debug().Str("account_hash", acc).Str("search_key", key).Int("limit", size).Msg("search results reach limit, search again with larger limit")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bucloud/hwapi"
+)
+
+func TestHostFilter(t *testing.T) {
+	hosts := []*hwapi.HostName{
+		{Name: "www.example.com", HostHash: "a1a1a1a1", AccountHash: "acc00001"},
+		{Name: "img.example.com", HostHash: "b2b2b2b2", AccountHash: "acc00001"},
+		{Name: "api.example.org", HostHash: "c3c3c3c3", AccountHash: "acc00002"},
+		{Name: "Staging.Example.com", HostHash: "d4d4d4d4", AccountHash: "acc00002"},
+		// duplicate returned by another pattern
+		{Name: "www.example.com", HostHash: "a1a1a1a1", AccountHash: "acc00001"},
+	}
+	defer func(p, e, r, er, a string) {
+		hostPattern, hostExclude, hostRegex, hostExcludeRegex, hostAccounts = p, e, r, er, a
+	}(hostPattern, hostExclude, hostRegex, hostExcludeRegex, hostAccounts)
+	cases := []struct {
+		name                                  string
+		pattern, exclude, re, excludeRe, accs string
+		want                                  string
+		wantErr                               bool
+	}{
+		{name: "no filter", want: "a1a1a1a1,b2b2b2b2,c3c3c3c3,d4d4d4d4"},
+		{name: "wildcard", pattern: "*.example.com", want: "a1a1a1a1,b2b2b2b2,d4d4d4d4"},
+		{name: "sub string", pattern: "example.org", want: "c3c3c3c3"},
+		{name: "case insensitive wildcard", pattern: "staging.*", want: "d4d4d4d4"},
+		{name: "hosthash wildcard", pattern: "b2b2*", want: "b2b2b2b2"},
+		{name: "multiple wildcards", pattern: "www.*, api.*", want: "a1a1a1a1,c3c3c3c3"},
+		{name: "exclude", pattern: "*.example.com", exclude: "img.*", want: "a1a1a1a1,d4d4d4d4"},
+		{name: "regex", re: `^(www|api)\.`, want: "a1a1a1a1,c3c3c3c3"},
+		{name: "regex on hosthash", re: `^c3`, want: "c3c3c3c3"},
+		{name: "wildcard or regex", pattern: "img.*", re: `\.org$`, want: "b2b2b2b2,c3c3c3c3"},
+		{name: "exclude regex", excludeRe: `example\.com$`, want: "c3c3c3c3,d4d4d4d4"},
+		{name: "account", accs: "acc00002", want: "c3c3c3c3,d4d4d4d4"},
+		{name: "account and wildcard", pattern: "*.example.com", accs: "acc00001", want: "a1a1a1a1,b2b2b2b2"},
+		{name: "nothing matched", pattern: "none.*", want: ""},
+		{name: "invalid wildcard", pattern: "[", wantErr: true},
+		{name: "invalid regex", re: "(", wantErr: true},
+		{name: "invalid exclude regex", excludeRe: "[", wantErr: true},
+	}
+	for _, c := range cases {
+		hostPattern, hostExclude, hostRegex, hostExcludeRegex, hostAccounts = c.pattern, c.exclude, c.re, c.excludeRe, c.accs
+		f, err := newHostFilter()
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: newHostFilter error %v, want error %t", c.name, err, c.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var got []string
+		for _, h := range f.filter(hosts) {
+			got = append(got, h.HostHash)
+		}
+		if strings.Join(got, ",") != c.want {
+			t.Errorf("%s: selected %s, want %s", c.name, strings.Join(got, ","), c.want)
+		}
+	}
+}
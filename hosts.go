@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/bucloud/hwapi"
+)
+
+// hostRecord host printed by hosts command
+type hostRecord struct {
+	Name        string `json:"name"`
+	HostHash    string `json:"host_hash"`
+	AccountHash string `json:"account_hash"`
+	AccountName string `json:"account_name"`
+}
+
+func hostsFlags(fs *flag.FlagSet) {
+	fs.StringVar(&hostPattern, "pattern", hostPattern, "list hosts match wildcard, use comma to split multiple patterns (default *)")
+	hostFilterFlags(fs)
+	fs.IntVar(&maxResult, "max", maxResult, "cap search results of each pattern, 0 means all results (up to 10000), a warning is logged when results are truncated")
+	fs.StringVar(&outputFormat, "format", outputFormat, "output format, table, json or csv")
+}
+
+// runHostsCommand list hosts of current account and its sub-accounts, search of striketracker covers sub-accounts
+func runHostsCommand(ctx context.Context, fs *flag.FlagSet) int {
+	if outputFormat != "table" && outputFormat != "json" && outputFormat != "csv" {
+		logger.Error().Msgf("invalid -format %s, table, json or csv expected", outputFormat)
+		return 1
+	}
+	if code := setupConfigure(false); code != 0 {
+		return code
+	}
+	api, cu, code := login()
+	if code != 0 {
+		return code
+	}
+	hosts, err := searchHosts(api, cu)
+	if err != nil {
+		logger.Error().Err(err).Msg("search hosts failed")
+		return 1
+	}
+	printHosts(hostRecords(cu, hosts))
+	return 0
+}
+
+// hostRecords dedupe and sort hosts by account then name, account name of current account is filled when absent
+func hostRecords(cu *hwapi.User, hosts []*hwapi.HostName) []*hostRecord {
+	seen := make(map[string]bool)
+	records := []*hostRecord{}
+	for _, h := range hosts {
+		if h == nil || seen[h.HostHash] {
+			continue
+		}
+		seen[h.HostHash] = true
+		r := &hostRecord{Name: h.Name, HostHash: h.HostHash, AccountHash: h.AccountHash, AccountName: h.AccountName}
+		if r.AccountName == "" && r.AccountHash == cu.AccountHash {
+			r.AccountName = cu.AccountName
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].AccountHash != records[j].AccountHash {
+			return records[i].AccountHash < records[j].AccountHash
+		}
+		return records[i].Name < records[j].Name
+	})
+	return records
+}
+
+func printHosts(records []*hostRecord) {
+	switch outputFormat {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(records)
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"name", "host_hash", "account_hash", "account_name"})
+		for _, r := range records {
+			w.Write([]string{r.Name, r.HostHash, r.AccountHash, r.AccountName})
+		}
+		w.Flush()
+	default:
+		fmt.Printf("# %-40s\t%-12s\t%-12s\t%s\n", "Hostname", "HostHash", "AccountHash", "AccountName")
+		for _, r := range records {
+			fmt.Printf("  %-40s\t%-12s\t%-12s\t%s\n", r.Name, r.HostHash, r.AccountHash, r.AccountName)
+		}
+		fmt.Printf("# %d hosts\n", len(records))
+	}
+}
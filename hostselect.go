@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bucloud/hwapi"
+)
+
+// onAmbiguous policy used when more then one hostnames found for -host, prompt|exact|first|all|fail,
+// empty means prompt when stdin is a terminal, exact otherwise
+var onAmbiguous string = ""
+
+var ambiguousPolicies = []string{"prompt", "exact", "first", "all", "fail"}
+
+// stdinIsTerminal whether stdin is an interactive terminal
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// ambiguousPolicy policy in effect
+func ambiguousPolicy() (string, error) {
+	if onAmbiguous == "" {
+		if stdinIsTerminal() {
+			return "prompt", nil
+		}
+		return "exact", nil
+	}
+	if !inSlice(ambiguousPolicies, onAmbiguous) {
+		return "", fmt.Errorf("invalid -on_ambiguous %s, available value %s", onAmbiguous, strings.Join(ambiguousPolicies, "|"))
+	}
+	return onAmbiguous, nil
+}
+
+// resolveHosts find hosts by -host or by -pattern, -regex and -account, -on_ambiguous decides which ones are used when more then one hostnames found
+func resolveHosts(api *hwapi.HWApi, cu *hwapi.User) ([]*hwapi.HostName, int) {
+	hosts := []*hwapi.HostName{}
+	if hosthashs == "" {
+		found, err := searchHosts(api, cu)
+		if err != nil {
+			logger.Error().Err(err).Msg("search host failed")
+			return nil, 1
+		}
+		return found, 0
+	}
+	policy, err := ambiguousPolicy()
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid flag")
+		return nil, 1
+	}
+	f, err := newHostFilter()
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid flag")
+		return nil, 1
+	}
+	for _, hosthash := range strings.Split(hosthashs, ",") {
+		// force search host
+		logger.Info().Str("account_hash", cu.AccountHash).Str("search_key", hosthash).Msg("search hosts by host")
+		hh, truncated, e := searchAll(api, cu.AccountHash, hosthash)
+		if e != nil {
+			logger.Error().Err(e).Str("account_hash", cu.AccountHash).Str("search_key", hosthash).Msg("search hosts failed")
+			return nil, 1
+		}
+		if truncated {
+			logger.Error().Str("account_hash", cu.AccountHash).Str("search_key", hosthash).Int("results", len(hh)).Msg("search results truncated, some hosts are missed, raise -max")
+		}
+		switch len(hh) {
+		case 1:
+			hosts = append(hosts, hh...)
+		case 0:
+			logger.Error().Str("host_hash", hosthash).Str("account_hash", cu.AccountHash).Str("account_name", cu.AccountName).Msg("hosts not found")
+			return nil, 2
+		default:
+			picked, err := pickHosts(hosthash, hh, policy)
+			if err != nil {
+				logger.Error().Err(err).Str("search_key", hosthash).Str("on_ambiguous", policy).Strs("candidates", hostLabels(hh)).Msg("ambiguous host")
+				return nil, 2
+			}
+			logger.Info().Str("search_key", hosthash).Str("on_ambiguous", policy).Strs("picked", hostLabels(picked)).Strs("candidates", hostLabels(hh)).Msg("more then one hostnames found")
+			hosts = append(hosts, picked...)
+		}
+	}
+	// -host with -pattern, -regex, -exclude or -account narrows hosts down
+	return f.filter(hosts), 0
+}
+
+// pickHosts pick hosts from search results of key by policy
+func pickHosts(key string, list []*hwapi.HostName, policy string) ([]*hwapi.HostName, error) {
+	switch policy {
+	case "first":
+		return list[:1], nil
+	case "all":
+		return list, nil
+	case "exact":
+		var exact []*hwapi.HostName
+		for _, h := range list {
+			if h.HostHash == key || strings.EqualFold(h.Name, key) {
+				exact = append(exact, h)
+			}
+		}
+		if len(exact) != 1 {
+			return nil, fmt.Errorf("%d hosts match %s exactly, use hosthash or -on_ambiguous first|all", len(exact), key)
+		}
+		return exact, nil
+	case "prompt":
+		picked := scanInput{
+			Placeholder: "found more then one hosthash, please pick one of them",
+			Default:     list[0].HostHash,
+			Options: func(list []*hwapi.HostName) []*inputOptions {
+				res := []*inputOptions{}
+				for _, h := range list {
+					res = append(res, &inputOptions{
+						Label: h.Name,
+						Value: h.HostHash,
+					})
+				}
+				return res
+			}(list),
+		}.scan()
+		for _, h := range list {
+			if h.HostHash == picked {
+				return []*hwapi.HostName{h}, nil
+			}
+		}
+		return nil, fmt.Errorf("hosthash %s not found", picked)
+	}
+	return nil, fmt.Errorf("%d hosts found", len(list))
+}
+
+func hostLabels(list []*hwapi.HostName) []string {
+	var res []string
+	for _, h := range list {
+		res = append(res, h.Name+"("+h.HostHash+")")
+	}
+	return res
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bucloud/hwapi"
+)
+
+const keysUsage = `usage: %s [flags] keys <command> [options] [accountHash ...]
+
+commands:
+  list   [accountHash ...]            list service accounts and HMAC keys, show scopes using each key
+  rotate <accountHash ...>            create new credential, update scope, then revoke the old one
+  prune  [-yes] [accountHash ...]     revoke HMAC keys not referenced by any configure scope
+
+account of current credential and all account scopes are used when accountHash absent
+`
+
+// exit codes of keys commands
+const (
+	keysExitOK    = 0
+	keysExitUsage = 1
+	keysExitSave  = 3
+	keysExitAPI   = 5
+)
+
+// accountKey HMAC key with its owner
+type accountKey struct {
+	AccountHash    string
+	ServiceAccount *hwapi.GCSAccount
+	Key            *hwapi.GCSHMacKey
+}
+
+// runKeysCommand run keys command, return exit code
+func runKeysCommand(api *hwapi.HWApi, cu *hwapi.User, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, keysUsage, os.Args[0])
+		return keysExitUsage
+	}
+	fs := flag.NewFlagSet("keys "+args[0], flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "revoke keys instead of print them only")
+	if e := fs.Parse(args[1:]); e != nil {
+		return keysExitUsage
+	}
+	accounts := fs.Args()
+	if len(accounts) == 0 {
+		accounts = Cfg.accountHashes(cu.AccountHash)
+	}
+	switch args[0] {
+	case "list":
+		return listKeys(api, accounts)
+	case "rotate":
+		if fs.NArg() == 0 {
+			break
+		}
+		return rotateKeys(api, cu, accounts)
+	case "prune":
+		return pruneKeys(api, accounts, *yes)
+	}
+	fmt.Fprintf(os.Stderr, keysUsage, os.Args[0])
+	return keysExitUsage
+}
+
+// accountHashes return current account and all scopes named by accountHash
+func (nc nsConfigure) accountHashes(current string) []string {
+	res := []string{current}
+	for n := range nc {
+		if len(n) == 8 && n != current && !strings.HasPrefix(n, "remote-") {
+			res = append(res, n)
+		}
+	}
+	sort.Strings(res[1:])
+	return res
+}
+
+// keyUsers return access id => names of scopes using it, access ids from vault_path are resolved and
+// the one provided by flags/env is used by "flags/env"; scopes which couldn't been resolved are reported
+// by error, the rest are returned anyway
+func (nc nsConfigure) keyUsers() (map[string][]string, error) {
+	res := make(map[string][]string)
+	var failed []string
+	for n, c := range nc {
+		if c == nil {
+			continue
+		}
+		rc := *c
+		if err := rc.resolveSecrets(); err != nil {
+			failed = append(failed, scopeLabel(n)+": "+err.Error())
+			continue
+		}
+		if rc.AccessKeyID != "" {
+			res[rc.AccessKeyID] = append(res[rc.AccessKeyID], n)
+		}
+	}
+	if o := accountOverride(); o.AccessKeyID != "" {
+		res[o.AccessKeyID] = append(res[o.AccessKeyID], "flags/env")
+	}
+	for _, scopes := range res {
+		sort.Strings(scopes)
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return res, fmt.Errorf("resolve secrets failed, %s", strings.Join(failed, "; "))
+	}
+	return res, nil
+}
+
+// accountHMacKeys list all HMAC keys of account
+func accountHMacKeys(api *hwapi.HWApi, accountHash string) ([]*accountKey, error) {
+	var res []*accountKey
+	sa, err := getGCSAccounts(api, accountHash)
+	if err != nil {
+		return nil, fmt.Errorf("get service_accounts failed %s", err.Error())
+	}
+	for _, s := range sa.List {
+		hmacs, err := getGCSHMacKeys(api, accountHash, s.ID)
+		if err != nil {
+			return nil, fmt.Errorf("get hmac_keys of service_account %s failed %s", s.Name, err.Error())
+		}
+		for _, k := range hmacs.List {
+			res = append(res, &accountKey{AccountHash: accountHash, ServiceAccount: s, Key: k})
+		}
+	}
+	return res, nil
+}
+
+func listKeys(api *hwapi.HWApi, accounts []string) int {
+	users, err := Cfg.keyUsers()
+	if err != nil {
+		logger.Warn().Err(err).Msg("usage of keys may be incomplete")
+	}
+	fmt.Printf("%-12s\t%-20s\t%-30s\t%-10s\t%s\n", "AccountHash", "ServiceAccount", "AccessID", "Age", "UsedBy")
+	for _, a := range accounts {
+		keys, err := accountHMacKeys(api, a)
+		if err != nil {
+			logger.Error().Err(err).Str("account_hash", a).Msg("list keys failed")
+			return keysExitAPI
+		}
+		for _, k := range keys {
+			fmt.Printf("%-12s\t%-20s\t%-30s\t%-10s\t%s\n", a, k.ServiceAccount.Name, k.Key.AccessID, keyAge(k.Key.CreatedAt), strings.Join(users[k.Key.AccessID], ","))
+		}
+	}
+	return keysExitOK
+}
+
+// keyAge age in days of key created at createdAt, "-" when it couldn't been parsed
+func keyAge(createdAt string) string {
+	t, err := time.Parse(time.RFC3339, createdAt)
+	if err != nil {
+		return "-"
+	}
+	return fmt.Sprintf("%dd", int(time.Since(t).Hours()/24))
+}
+
+func rotateKeys(api *hwapi.HWApi, cu *hwapi.User, accounts []string) int {
+	if configReadOnly {
+		logger.Error().Msg("configure file not found, rotated key can't been saved")
+		return keysExitSave
+	}
+	for _, a := range accounts {
+		c, err := Cfg.accountConfigure(a, cu.AccountHash)
+		if err != nil {
+			logger.Error().Err(err).Str("account_hash", a).Msg("resolve configure failed")
+			return keysExitUsage
+		}
+		if c.credentialID() == "" {
+			logger.Error().Str("account_hash", a).Msg("no credential configured in scope, nothing to rotate")
+			return keysExitUsage
+		}
+		if err := rotateCredential(api, a, cu.AccountHash, ""); err != nil {
+			logger.Error().Err(err).Str("account_hash", a).Msg("rotate credential failed")
+			return keysExitAPI
+		}
+	}
+	return keysExitOK
+}
+
+func pruneKeys(api *hwapi.HWApi, accounts []string, yes bool) int {
+	if configReadOnly {
+		// every key looks unreferenced without configure file
+		logger.Error().Msg("configure file not found, refuse to prune keys")
+		return keysExitSave
+	}
+	users, err := Cfg.keyUsers()
+	if err != nil {
+		// key of unresolved scope would look unreferenced
+		logger.Error().Err(err).Msg("refuse to prune keys")
+		return keysExitSave
+	}
+	for _, a := range accounts {
+		keys, err := accountHMacKeys(api, a)
+		if err != nil {
+			logger.Error().Err(err).Str("account_hash", a).Msg("list keys failed")
+			return keysExitAPI
+		}
+		for _, k := range keys {
+			if len(users[k.Key.AccessID]) > 0 {
+				continue
+			}
+			if !yes {
+				fmt.Printf("%s\t%s\t%s\twould been revoked, use -yes to revoke it\n", a, k.ServiceAccount.Name, k.Key.AccessID)
+				continue
+			}
+			if _, err := api.DeleteGCSHMacKey(a, k.ServiceAccount.ID, k.Key.ID); err != nil {
+				logger.Error().Err(err).Str("account_hash", a).Str("access_id", k.Key.AccessID).Msg("revoke hmac_key failed")
+				return keysExitAPI
+			}
+			fmt.Printf("%s\t%s\t%s\trevoked\n", a, k.ServiceAccount.Name, k.Key.AccessID)
+		}
+	}
+	return keysExitOK
+}
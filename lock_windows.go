@@ -0,0 +1,29 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockFile acquire lock by creating lock file exclusively, wait at most 30 seconds
+func lockFile(path string) (func(), error) {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("wait lock %s timeout, remove it if no other process is running", path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -1,32 +1,39 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/VictoriaMetrics/fastcache"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/bucloud/hwapi"
 	"github.com/rs/zerolog"
+	"gopkg.in/ini.v1"
 )
 
 var (
 	start                  time.Time     = time.Now().UTC().Add(-time.Hour * 24)
 	end                    time.Time     = time.Now().UTC()
-	maxResult              int           = 10
+	maxResult              int           = 0
 	forceGenerate          bool          = false
 	keyLimit               int           = 3
 	worker                 int           = 1
+	hostWorkers            int           = 4
 	hosthashs              string        = ""
 	hostPattern            string        = ""
 	logtype                string        = "cds"
-	user                   string        = ""
-	password               string        = ""
 	output                 string        = "./"
 	showSecret             bool          = false
 	autoGenerateCredential bool          = false
@@ -34,6 +41,8 @@ var (
 	loopInterval           time.Duration = time.Minute * 0
 	fixTime                bool          = true
 	config                 string        = configFile
+	startFlag              string        = ""
+	endFlag                string        = ""
 	stateDir               string        = "./.state"
 	stateSize              int           = 256 * 1024 * 1024
 
@@ -45,31 +54,15 @@ var (
 	logger zerolog.Logger
 )
 
-func init() {
-	s := flag.String("s", time.Now().UTC().Add(-time.Hour*24).Format(time.RFC3339), "download log from time, RFC3339 format is supported")
-	e := flag.String("e", time.Now().UTC().Format(time.RFC3339), "download log till time, RFC3339 format is supported")
-	flag.StringVar(&hosthashs, "host", hosthashs, "set hosthash, use comma to split multiple hosthash")
-	flag.StringVar(&hostPattern, "pattern", hostPattern, "use host pattern as host, this will download all logs for host match pattern, Note, only support wildcard")
-	flag.StringVar(&logtype, "t", logtype, "set logtype, available value cds,cdi")
-	flag.StringVar(&output, "d", output, "set directory to store logfiles, support local and AWS s3, use {remoteConfigName}:{prefix} when use AWS s3 as destination")
-	flag.StringVar(&loglevel, "log", loglevel, "set loglevel to print, [panic,fatal,error,warn,info,debug,trace] are available value")
-	flag.StringVar(&config, "config", config, "use speicaled config file or config scope name")
-	flag.IntVar(&worker, "n", worker, "set workers")
-	flag.IntVar(&maxResult, "max", maxResult, "set max search results")
-	flag.BoolVar(&showSecret, "show_secret", showSecret, "show secert data instead of hide them")
-	flag.BoolVar(&autoGenerateCredential, "auto", autoGenerateCredential, "auto generate credential(access_key_id,secret_key), note credential will not generated when there are 3 credentials already exists")
-	flag.BoolVar(&forceGenerate, "force_generate", forceGenerate, "force generate credentials if there are 3 credentials already exists in account")
-	flag.DurationVar(&loopInterval, "loop", loopInterval, "loop download logs with a provided time range, zero means disable loop")
-	flag.BoolVar(&fixTime, "fix_time", fixTime, "fix start/end time in loop download mode")
-	flag.StringVar(&stateDir, "c", stateDir, "set cache data dir")
-	flag.IntVar(&stateSize, "cs", stateSize, "set cache data maximum size")
-	flag.Parse()
-
+// setupLogger init logger with -log level
+func setupLogger() {
 	switch loglevel {
 	case "debug":
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	case "info":
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	case "warn":
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
 	default:
 		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
 	}
@@ -87,241 +80,307 @@ func init() {
 		return fmt.Sprintf("%s", i)
 	}
 	logger = zerolog.New(output).With().Timestamp().Logger()
+}
 
-	if st, e1 := time.Parse("2006-01-02T15:04:05Z", *s); *s != "" && e1 == nil {
-		start = st
-	}
-
-	if et, e2 := time.Parse("2006-01-02T15:04:05Z", *e); *e != "" && e2 == nil {
-		end = et
-	}
-
-	if _, e := os.Open(config); e == nil {
+// setupConfigure load configure selected by -config, configure is optional when settings come from flags/env,
+// editable is true for config command which creates configure file when it's absent
+func setupConfigure(editable bool) int {
+	if _, e := os.Stat(config); e == nil || isConfigFile(config) {
 		configFile = config
 		config = ""
 	}
 	var err error
 	Cfg, err = loadConfig()
-	if len(os.Args) == 2 && os.Args[1] == "config" {
-		Cfg = Cfg.editConfig()
-		if err := Cfg.save(); err != nil {
-			logger.Error().Err(err).Msg("edit configure failed")
-		}
-		os.Exit(0)
-	} else {
-		if err != nil {
-			logger.Error().Err(err).Msg("load configure failed")
-			os.Exit(3)
-		}
+	if err == nil {
+		return 0
 	}
-
-	if hosthashs == "" && hostPattern == "" {
-		logger.Fatal().Msg("host/pattern must provided")
-		os.Exit(1)
+	if _, e := os.Stat(configFile); !os.IsNotExist(e) || (!editable && !hasOverride()) {
+		// never overwrite exists configure which can't been parsed
+		logger.Error().Err(err).Msg("load configure failed")
+		return 3
+	}
+	Cfg = make(nsConfigure)
+	if !editable {
+		// run with flags/env only
+		configReadOnly = true
 	}
+	return 0
+}
 
+// transport shared by hwapi and log files, so dial/TLS timeouts and connection limits apply to both
+var transport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout:   60 * time.Second,
+		KeepAlive: 60 * time.Second,
+		DualStack: true,
+	}).DialContext,
+	MaxConnsPerHost:     20,
+	MaxIdleConns:        100,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
 }
 
-func main() {
-	conf := Cfg.Default(config)
-	if conf == nil {
-		logger.Panic().Msg("default/global configure not found")
-		os.Exit(3)
-	}
-	api := hwapi.Init(
-		&http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   60 * time.Second,
-				KeepAlive: 60 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxConnsPerHost:     20,
-			MaxIdleConns:        100,
-			IdleConnTimeout:     90 * time.Second,
-			TLSHandshakeTimeout: 10 * time.Second,
-		},
+// newAPI create api, download state is loaded by openState only, hwapi's downloader isn't used
+// so it gets an empty cache instead of loading state dir once more
+func newAPI() *hwapi.HWApi {
+	return hwapi.Init(
+		transport,
 		&logger,
-		&hwapi.LocalCacheConfig{FilePath: stateDir, MaxSize: stateSize},
+		fastcache.New(1),
 		worker,
 	)
-	if strings.Index(output, ":") > 0 {
-		remoteName := output[:strings.Index(output, ":")]
-		remotePath := output[strings.Index(output, ":")+1:]
-		if Cfg["remote-"+remoteName] == nil {
-			logger.Fatal().Msgf("remote configure %s not found", remoteName)
-			os.Exit(5)
-		}
-		api.SetRemoteS3Conf(remoteName, &aws.Config{
-			Region:      aws.String(Cfg["remote-"+remoteName].Region),
-			Credentials: credentials.NewStaticCredentials(Cfg["remote-"+remoteName].AccessKeyID, Cfg["remote-"+remoteName].SecretAccessKey, ""),
-		})
-		output = remoteName + ":" + Cfg["remote-"+remoteName].BucketName + ":" + remotePath
-	}
+}
+
+// authenticate set token or exchange username/password for token
+func authenticate(api *hwapi.HWApi, conf *configure) error {
 	if conf.AuthType == "token" {
 		api.SetToken(conf.Token)
-	} else {
-		if _, e := api.Auth(conf.Username, conf.Password, end.Before(hcsDeprecatedFrom)); e != nil {
-			logger.Error().Err(e).Msg("get accesstoken failed")
-			os.Exit(4)
+		return nil
+	}
+	_, e := api.Auth(conf.Username, conf.Password, end.Before(hcsDeprecatedFrom))
+	return e
+}
+
+// exitInterrupted exit code when SIGINT/SIGTERM received
+const exitInterrupted = 130
+
+func main() {
+	// first SIGINT/SIGTERM cancels ctx, so no more files are started and state is kept,
+	// second one saves state and exits immediately
+	rand.Seed(time.Now().UnixNano())
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		fmt.Fprintf(os.Stderr, "%s received, stopping after in-flight files are aborted, send again to exit immediately\n", s)
+		cancel()
+		<-sig
+		if st := openedState(); st != nil {
+			if e := st.save(); e != nil {
+				logger.Error().Err(e).Str("state_dir", stateDir).Msg("save download state failed")
+			}
 		}
+		os.Exit(exitInterrupted)
+	}()
+	os.Exit(run(ctx, os.Args[1:]))
+}
+
+// login resolve selected configure, authenticate and return current user
+func login() (*hwapi.HWApi, *hwapi.User, int) {
+	conf, err := Cfg.resolveConfigure(config)
+	if err != nil {
+		logger.Error().Err(err).Msg("resolve configure failed")
+		return nil, nil, 3
+	}
+	if err := conf.resolveSecrets(); err != nil {
+		logger.Error().Err(err).Msg("read secrets failed")
+		return nil, nil, 3
+	}
+	if conf.Token == "" && conf.Username == "" {
+		logger.Error().Msg("default/global configure not found")
+		return nil, nil, 3
+	}
+	api := newAPI()
+	if e := authenticate(api, conf); e != nil {
+		logger.Error().Err(e).Msg("get accesstoken failed")
+		return nil, nil, 4
 	}
 	cu, e := api.AboutMe()
 	if e != nil {
 		logger.Error().Err(e).Msg("get account info failed")
-		os.Exit(2)
-	}
-	hosts := []*hwapi.HostName{}
-	if hostPattern != "" {
-		logger.Info().Str("account_hash", cu.AccountHash).Str("search_key", hostPattern).Msg("search hosts by pattern")
-		r, e := api.Search(cu.AccountHash, hostPattern, maxResult)
-		if e != nil {
-			logger.Error().Err(e).Msg("search host failed")
-		}
-		hosts = append(hosts, r.Hostnames...)
-	} else {
-		for _, hosthash := range strings.Split(hosthashs, ",") {
-			// force search host
-			logger.Info().Str("account_hash", cu.AccountHash).Str("search_key", hosthash).Msg("search hosts by host")
-			r, e := api.Search(cu.AccountHash, hosthash, maxResult)
-			if e != nil {
-				logger.Error().Err(e).Str("account_hash", cu.AccountHash).Str("search_key", hosthash).Msg("search hosts failed")
-				os.Exit(1)
+		return nil, nil, 2
+	}
+	return api, cu, 0
+}
+
+// setupOutput create uploader of remote configure when output is {remoteConfigName}:{prefix}
+func setupOutput() int {
+	if strings.Index(output, ":") <= 0 {
+		return 0
+	}
+	remoteName := output[:strings.Index(output, ":")]
+	remotePath := output[strings.Index(output, ":")+1:]
+	rc := Cfg.resolveRemote(remoteName)
+	if rc == nil {
+		logger.Error().Msgf("remote configure %s not found", remoteName)
+		return 5
+	}
+	if err := rc.resolveSecrets(); err != nil {
+		logger.Error().Err(err).Msgf("read secrets of remote configure %s failed", remoteName)
+		return 5
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(rc.Region),
+		Credentials: credentials.NewStaticCredentials(rc.AccessKeyID, rc.SecretAccessKey, ""),
+	})
+	if err != nil {
+		logger.Error().Err(err).Msgf("create session of remote configure %s failed", remoteName)
+		return 5
+	}
+	remoteUploader = s3manager.NewUploader(sess)
+	output = remoteName + ":" + rc.BucketName + ":" + remotePath
+	return 0
+}
+
+// accountCredential resolve configure of host's account with flags/env applied, rotate credential when it's expired
+func accountCredential(api *hwapi.HWApi, cu *hwapi.User, h *hwapi.HostName) (*configure, int) {
+	resolve := func() (*configure, error) {
+		cfgMu.Lock()
+		defer cfgMu.Unlock()
+		return Cfg.accountConfigure(h.AccountHash, cu.AccountHash)
+	}
+	cfgMu.Lock()
+	missing := Cfg[h.AccountHash] == nil
+	cfgMu.Unlock()
+	if missing {
+		err := updateConfig(func() {
+			if Cfg[h.AccountHash] != nil {
+				return
 			}
-			hh := r.Hostnames
-			switch len(hh) {
-			case 1:
-				hosts = append(hosts, r.Hostnames...)
-			case 0:
-				logger.Fatal().Str("host_hash", hosthash).Str("account_hash", cu.AccountHash).Str("account_name", cu.AccountName).Msg("hosts not found")
-				os.Exit(2)
-			default:
-				hosts = append(hosts, func(list []*hwapi.HostName, hosthash string) *hwapi.HostName {
-					for _, h := range list {
-						if h.HostHash == hosthash {
-							return h
-						}
-					}
-					return nil
-				}(hh, scanInput{
-					Placeholder: "found more then one hosthash, please pick one of them",
-					Default:     hh[0].HostHash,
-					Options: func(list []*hwapi.HostName) []*inputOptions {
-						res := []*inputOptions{}
-						for _, h := range list {
-							res = append(res, &inputOptions{
-								Label: h.Name,
-								Value: h.HostHash,
-							})
-						}
-						return res
-					}(hh),
-				}.scan()))
+			// account scope only holds its own credentials, others are inherited
+			Cfg[h.AccountHash] = &configure{}
+			if Cfg[config] != nil && config != h.AccountHash && config != ini.DefaultSection {
+				Cfg[h.AccountHash].Inherits = config
 			}
+		})
+		if err != nil {
+			logger.Error().Err(err).Str("account_hash", h.AccountHash).Msg("save configure failed")
 		}
 	}
-	// parse raw log urls
-	// allurls := []string{}
-	for {
-		ts := time.Now()
-		// for _, h := range hosts {
-		for i := 1; i <= len(hosts); i++ {
-			h := hosts[i-1]
-			startTime := time.Now()
-			hcred := &hwapi.HCSCredentials{}
-			if Cfg[h.AccountHash] == nil {
-				Cfg[h.AccountHash] = Cfg.Default(config)
-				if h.AccountHash != cu.AccountHash {
-					Cfg[h.AccountHash].AccessKeyID = ""
-					Cfg[h.AccountHash].SecretAccessKey = ""
-					Cfg[h.AccountHash].PrivateKeyJSON = ""
-				}
-				Cfg.save()
-			}
+	resolved, e := resolve()
+	if e != nil {
+		logger.Error().Err(e).Str("account_hash", h.AccountHash).Msg("resolve configure failed")
+		return nil, 3
+	}
+	// credentials provided by flags/env take precedence
+	ac := mergeConfigure(accountOverride(), resolved)
+	if ac.credentialID() == resolved.credentialID() && resolved.needRotate(ac.RotateAfter) && !configReadOnly {
+		if err := rotateCredential(api, h.AccountHash, cu.AccountHash, ac.RotateAfter); err != nil {
+			logger.Error().Err(err).Str("account_hash", h.AccountHash).Msg("rotate credential failed, keep using current one")
+		}
+		resolved, _ = resolve()
+		ac = mergeConfigure(accountOverride(), resolved)
+	}
+	if e := ac.resolveSecrets(); e != nil {
+		logger.Error().Err(e).Str("account_hash", h.AccountHash).Msg("read secrets failed")
+		return nil, 3
+	}
+	return ac, 0
+}
 
-			if (Cfg[h.AccountHash].AccessKeyID == "" || Cfg[h.AccountHash].SecretAccessKey == "") && Cfg[h.AccountHash].PrivateKeyJSON == "" && autoGenerateCredential {
-				logger.Debug().Str("account_hash", h.AccountHash).Msg("try auto generate service_account")
-				// get gcs account
-				var serviceAccount *hwapi.GCSAccount
-				sa, err := api.GetGCSAccounts(h.AccountHash)
-				if err != nil || len(sa.List) == 0 {
-					// try create gcs account
-					if serviceAccount, err = api.CreateGCSAccount(h.AccountHash, "auto generate log account", "log_account"); err != nil {
-						logger.Error().Err(err).Str("account_hash", h.AccountHash).Msg("create service_account failed")
-						os.Exit(5)
-					}
-				} else {
-					serviceAccount = sa.List[0]
-				}
-				logger.Debug().Str("account_hash", h.AccountHash).Msg("try auto generate hmac_keys")
-				// try generate HMAC_key
-				hmacs, err := api.GetGCSHMacKeys(h.AccountHash, serviceAccount.ID)
-				if err != nil || len(hmacs.List) <= keyLimit || (len(hmacs.List) > keyLimit && forceGenerate) {
-					// try generate hmac_key
-					hmac, err := api.CreateGCSHMacKey(h.AccountHash, serviceAccount.ID)
-					if err != nil {
-						logger.Error().Err(err).Str("account_hash", h.AccountHash).Str("service_account_name", serviceAccount.Name).Msg("create service_account failed")
-						os.Exit(5)
-					}
-					Cfg[h.AccountHash] = &configure{}
-					Cfg[h.AccountHash].AccessKeyID = hmac.AccessID
-					hcred.AccessKeyID = hmac.AccessID
-					Cfg[h.AccountHash].SecretAccessKey = hmac.Secret
-					hcred.SecretKey = hmac.Secret
-					Cfg.save()
-				} else {
-					logger.Error().Msg("hmac_key generate failed, try create it manually")
-					os.Exit(5)
-				}
-			} else if (Cfg[h.AccountHash].AccessKeyID != "" && Cfg[h.AccountHash].SecretAccessKey != "") || Cfg[h.AccountHash].PrivateKeyJSON != "" {
-				hcred.AccessKeyID = Cfg[h.AccountHash].AccessKeyID
-				hcred.SecretKey = Cfg[h.AccountHash].SecretAccessKey
-				hcred.PrivateKeyJSON = Cfg[h.AccountHash].PrivateKeyJSON
-			} else {
-				logger.Error().Str("account_hash", h.AccountHash).Msg("subAccounts's configure not found, please create new config")
-				os.Exit(3)
-			}
-			logger.Trace().Str("seq", fmt.Sprintf("%d/%d", i, len(hosts))).Str("host_hash", h.HostHash).Time("from", start).Time("to", end).Str("type", logtype).Msg("begin search raw logs")
+// hostCredential resolve credential used to access raw logs of host, rotate or generate it when needed,
+// it's safe for concurrent use, hosts of the same account wait for each other so its credential is generated once
+func hostCredential(api *hwapi.HWApi, cu *hwapi.User, h *hwapi.HostName) (*hwapi.HCSCredentials, int) {
+	unlock := lockAccount(h.AccountHash)
+	defer unlock()
+	hcred := &hwapi.HCSCredentials{}
+	ac, code := accountCredential(api, cu, h)
+	if code != 0 {
+		return nil, code
+	}
+	if ac.hasCredential() {
+		hcred.AccessKeyID = ac.AccessKeyID
+		hcred.SecretKey = ac.SecretAccessKey
+		hcred.PrivateKeyJSON = ac.PrivateKeyJSON
+	} else if autoGenerateCredential {
+		cred, err := generateCredential(api, h.AccountHash, ac.CredentialType)
+		if err != nil {
+			logger.Error().Err(err).Str("account_hash", h.AccountHash).Str("credential_type", ac.CredentialType).Msg("generate credential failed")
+			return nil, 5
+		}
+		hcred.AccessKeyID = cred.AccessKeyID
+		hcred.SecretKey = cred.SecretAccessKey
+		hcred.PrivateKeyJSON = cred.PrivateKeyJSON
+		if err := updateConfig(func() { Cfg[h.AccountHash].copyCredential(cred) }); err != nil {
+			// unsaved credential would make next run generate another one
+			logger.Error().Err(err).Str("account_hash", h.AccountHash).Str("credential_id", cred.credentialID()).Msg("save generated credential failed, save it manually or revoke it")
+			return nil, 3
+		}
+	} else {
+		logger.Error().Str("account_hash", h.AccountHash).Msg("subAccounts's configure not found, please create new config")
+		return nil, 3
+	}
+	return hcred, 0
+}
 
-			var urls []string
-			var err error
-			if end.Before(hcsDeprecatedFrom) {
-				urls, err = api.SearchLogs(h.HostHash, logtype, start, end)
-			} else {
-				urls, err = api.SearchLogsV2(&hwapi.SearchLogsOptions{
-					HostHash:       h.HostHash,
-					AccountHash:    h.AccountHash,
-					StartDate:      start,
-					EndDate:        end,
-					LogType:        logtype,
-					HCSCredentials: hcred,
-				})
-			}
+// searchLogs search raw log urls of host with type t between start and end
+func searchLogs(api *hwapi.HWApi, h *hwapi.HostName, t string, hcred *hwapi.HCSCredentials) ([]string, error) {
+	if end.Before(hcsDeprecatedFrom) {
+		return api.SearchLogs(h.HostHash, t, start, end)
+	}
+	return api.SearchLogsV2(&hwapi.SearchLogsOptions{
+		HostHash:       h.HostHash,
+		AccountHash:    h.AccountHash,
+		StartDate:      start,
+		EndDate:        end,
+		LogType:        t,
+		HCSCredentials: hcred,
+	})
+}
 
-			if err != nil {
-				logger.Error().Err(err).Str("seq", fmt.Sprintf("%d/%d", i, len(hosts))).Str("host_hash", h.HostHash).Time("from", start).Time("to", end).Str("type", logtype).Msg("search logs failed")
-				os.Exit(1)
-			}
-			if len(urls) == 0 {
-				logger.Info().Str("seq", fmt.Sprintf("%d/%d", i, len(hosts))).Str("host_hash", h.Name+"("+h.HostHash+")").Time("from", start).Time("to", end).Str("type", logtype).Msg("found nothing, handle next")
-				continue
-			}
-			logger.Info().Str("seq", fmt.Sprintf("%d/%d", i, len(hosts))).Str("host_hash", h.Name+"("+h.HostHash+")").Time("from", start).Time("to", end).Str("type", logtype).Int("file_number", len(urls)).Msg("search raw log succeed")
-			tempDir := output
-			if strings.LastIndex(output, ":") > 0 {
-				tempDir = tempDir + "/" + h.Name + "/"
-			}
-			if _, e := api.Downloads(tempDir, urls...); e != nil {
-				logger.Error().Err(e).Str("seq", fmt.Sprintf("%d/%d", i, len(hosts))).Str("host", h.Name+"("+h.HostHash+")").Time("from", start).Time("to", end).Str("type", logtype).Int("file_number", len(urls)).Msg("download logs failed")
-			} else {
-				logger.Info().Str("seq", fmt.Sprintf("%d/%d", i, len(hosts))).Str("host", h.Name+"("+h.HostHash+")").Time("from", start).Time("to", end).Str("type", logtype).Int("file_number", len(urls)).Dur("spent", time.Since(startTime)).Msg("download complete")
-			}
+// targetDir directory raw logs of host with type t are stored in, hosts have their own prefix on remote storage
+func targetDir(h *hwapi.HostName, t string) string {
+	if strings.LastIndex(output, ":") > 0 {
+		return typeDir(output+"/"+h.Name+"/", t)
+	}
+	return typeDir(output, t)
+}
+
+// runDownload download raw logs of hosts, in loop when -loop provided,
+// it stops between files when ctx is cancelled, completed files are kept in state
+func runDownload(ctx context.Context) int {
+	types, err := logTypes()
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid -t")
+		return 1
+	}
+	api, cu, code := login()
+	if code != 0 {
+		return code
+	}
+	if code := setupOutput(); code != 0 {
+		return code
+	}
+	hosts, code := resolveHosts(api, cu)
+	if code != 0 {
+		return code
+	}
+	if dryRun {
+		return runPlan(api, cu, hosts, types)
+	}
+	st, err := openState(stateDir)
+	if err != nil {
+		logger.Error().Err(err).Str("state_dir", stateDir).Msg("open download state failed")
+		return 1
+	}
+	setOpenedState(st)
+	defer func() {
+		setOpenedState(nil)
+		st.close()
+	}()
+	d := &downloader{api: api, st: st, mf: newManifest(manifestDir(), time.Now()), pool: newFilePool(worker)}
+	defer d.close()
+	for {
+		ts := time.Now()
+		summary := d.downloadRound(ctx, api, cu, hosts, types)
+		summary.print(os.Stderr)
+		if ctx.Err() != nil {
+			logger.Error().Msg("interrupted, completed files are kept in state")
+			return exitInterrupted
 		}
+		serveStatus.update(start, end, len(hosts))
 		if loopInterval == time.Minute*0 {
-			break
+			return summary.exitCode()
 		}
 		if time.Since(ts) <= loopInterval {
 			logger.Debug().Dur("sleep", loopInterval-time.Since(ts)).Msg("sleep awhile")
-			time.Sleep(loopInterval - time.Since(ts))
+			select {
+			case <-time.After(loopInterval - time.Since(ts)):
+			case <-ctx.Done():
+				logger.Info().Msg("interrupted while sleeping")
+				return exitInterrupted
+			}
 		}
 		if fixTime {
 			start = start.Add(loopInterval - time.Minute)
@@ -329,3 +388,89 @@ func main() {
 		}
 	}
 }
+
+// downloadRound download logs of every host/type pair once by -host_workers hosts at a time,
+// failed pair is recorded and next one is handled
+func (d *downloader) downloadRound(ctx context.Context, api *hwapi.HWApi, cu *hwapi.User, hosts []*hwapi.HostName, types []string) *runSummary {
+	summary := &runSummary{pairs: make([]*pairResult, len(hosts)*len(types))}
+	n := hostWorkers
+	if n < 1 {
+		n = 1
+	}
+	if n > len(hosts) {
+		n = len(hosts)
+	}
+	var wg sync.WaitGroup
+	queue := make(chan int)
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				d.downloadHost(ctx, api, cu, hosts, i, types, summary)
+			}
+		}()
+	}
+feed:
+	for i := range hosts {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return summary
+}
+
+// downloadHost download logs of hosts[i] for each type, results are stored in summary
+func (d *downloader) downloadHost(ctx context.Context, api *hwapi.HWApi, cu *hwapi.User, hosts []*hwapi.HostName, i int, types []string, summary *runSummary) {
+	h := hosts[i]
+	seq := fmt.Sprintf("%d/%d", i+1, len(hosts))
+	hcred, code := hostCredential(api, cu, h)
+	for j, t := range types {
+		if ctx.Err() != nil {
+			return
+		}
+		p := &pairResult{Host: h.Name, HostHash: h.HostHash, Type: t}
+		summary.pairs[i*len(types)+j] = p
+		if code != 0 {
+			p.Err = fmt.Sprintf("credential unavailable (code %d)", code)
+			continue
+		}
+		startTime := time.Now()
+		logger.Trace().Str("seq", seq).Str("host_hash", h.HostHash).Time("from", start).Time("to", end).Str("type", t).Msg("begin search raw logs")
+
+		var urls []string
+		err := retry(ctx, "search logs of "+h.HostHash, func() (e error) {
+			urls, e = searchLogs(api, h, t, hcred)
+			return e
+		})
+		if err != nil {
+			logger.Error().Err(err).Str("seq", seq).Str("host_hash", h.HostHash).Time("from", start).Time("to", end).Str("type", t).Msg("search logs failed")
+			p.Err = "search logs failed " + err.Error()
+			continue
+		}
+		p.Files = len(urls)
+		if len(urls) == 0 {
+			logger.Info().Str("seq", seq).Str("host_hash", h.Name+"("+h.HostHash+")").Time("from", start).Time("to", end).Str("type", t).Msg("found nothing, handle next")
+			continue
+		}
+		logger.Info().Str("seq", seq).Str("host_hash", h.Name+"("+h.HostHash+")").Time("from", start).Time("to", end).Str("type", t).Int("file_number", len(urls)).Msg("search raw log succeed")
+		res, e := d.fetchFiles(ctx, targetDir(h, t), h, t, urls)
+		if se := d.st.save(); se != nil {
+			logger.Warn().Err(se).Str("state_dir", stateDir).Msg("save download state failed")
+		}
+		p.Downloaded, p.Skipped, p.Failed = res.Downloaded, res.Skipped, res.Failed
+		if e == context.Canceled {
+			logger.Error().Str("seq", seq).Str("host", h.Name+"("+h.HostHash+")").Str("type", t).Int("downloaded", res.Downloaded).Int("skipped", res.Skipped).Msg("interrupted, completed files are kept in state")
+			p.Err = "interrupted"
+			return
+		} else if e != nil {
+			logger.Error().Err(e).Str("seq", seq).Str("host", h.Name+"("+h.HostHash+")").Time("from", start).Time("to", end).Str("type", t).Int("file_number", len(urls)).Int("downloaded", res.Downloaded).Int("skipped", res.Skipped).Msg("download logs failed")
+		} else {
+			logger.Info().Str("seq", seq).Str("host", h.Name+"("+h.HostHash+")").Time("from", start).Time("to", end).Str("type", t).Int("file_number", len(urls)).Int("downloaded", res.Downloaded).Int("skipped", res.Skipped).Dur("spent", time.Since(startTime)).Msg("download complete")
+		}
+	}
+}
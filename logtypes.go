@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// availableLogTypes raw log types provided by striketracker
+var availableLogTypes = []string{"cds", "cdi"}
+
+// logTypes parse comma separated -t, every host is processed once for each type
+func logTypes() ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(logtype, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || inSlice(types, t) {
+			continue
+		}
+		if !inSlice(availableLogTypes, t) {
+			return nil, fmt.Errorf("unknown log type %s, available value %s", t, strings.Join(availableLogTypes, ","))
+		}
+		types = append(types, t)
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("log type must provided")
+	}
+	return types, nil
+}
+
+// multipleTypes whether more than one log type requested, each type gets its own sub dir of output then
+func multipleTypes() bool {
+	types, _ := logTypes()
+	return len(types) > 1
+}
+
+// typeDir sub dir of dir for log type when more than one type requested
+func typeDir(dir, t string) string {
+	if !multipleTypes() {
+		return dir
+	}
+	return path.Join(dir, t) + "/"
+}
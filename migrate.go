@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"gopkg.in/ini.v1"
+)
+
+// configVersion current schema version of configure file
+const configVersion = 2
+
+// configMigrations migrations[i] upgrade configure from version i+1 to i+2,
+// they work on raw scope name => key => value, so renamed or removed keys could been handled
+var configMigrations = []func(raw map[string]map[string]string) error{
+	migrateV1,
+}
+
+// migrateConfig upgrade raw configure to configVersion in place, return original version
+func migrateConfig(raw map[string]map[string]string) (int, error) {
+	version := 1
+	if d := raw[ini.DefaultSection]; d != nil {
+		if v, ok := d["version"]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid configure version %s", v)
+			}
+			version = n
+		}
+		delete(d, "version")
+	}
+	if version > configVersion {
+		return version, fmt.Errorf("configure version %d is newer than supported version %d, please upgrade logdownloader", version, configVersion)
+	}
+	for v := version; v < configVersion; v++ {
+		if err := configMigrations[v-1](raw); err != nil {
+			return version, fmt.Errorf("migrate configure from version %d failed %s", v, err.Error())
+		}
+	}
+	return version, nil
+}
+
+// migrateV1 account scopes used to be copies of default scope, drop copied striketracker
+// auth keys so they're inherited, and record credential_type of exists credentials
+func migrateV1(raw map[string]map[string]string) error {
+	def := raw[ini.DefaultSection]
+	for name, kv := range raw {
+		if name != ini.DefaultSection && accountHashPattern.MatchString(name) && def != nil {
+			for _, k := range []string{"auth_type", "user_name", "password", "token"} {
+				if kv[k] != "" && kv[k] == def[k] {
+					delete(kv, k)
+				}
+			}
+		}
+		if kv["credential_type"] == "" {
+			if kv["private_key_json"] != "" {
+				kv["credential_type"] = "private_key"
+			} else if kv["access_key_id"] != "" {
+				kv["credential_type"] = "hmac"
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	accountHashPattern = regexp.MustCompile(`^[a-z0-9]{8}$`)
+	remoteScopePattern = regexp.MustCompile(`^remote-[A-Za-z0-9_.-]+$`)
+	profilePattern     = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// validateConfig report unknown keys, invalid scope names, invalid values and missing required keys
+func validateConfig(path string) ([]string, error) {
+	raw, err := decodeConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := takeEncryptedMarker(raw); err != nil {
+		return nil, err
+	}
+	if _, err := migrateConfig(raw); err != nil {
+		return nil, err
+	}
+	nc, _, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	inherited := make(map[string]bool)
+	for _, c := range nc {
+		inherited[scopeName(c.Inherits)] = true
+	}
+	var problems []string
+	names := make([]string, 0, len(raw))
+	for n := range raw {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		report := func(format string, a ...interface{}) {
+			problems = append(problems, fmt.Sprintf("[%s] ", name)+fmt.Sprintf(format, a...))
+		}
+		remote := remoteScopePattern.MatchString(name)
+		switch {
+		case name == ini.DefaultSection, remote, accountHashPattern.MatchString(name):
+		case inherited[name] && profilePattern.MatchString(name):
+			// profile only used by inherits or -config
+		default:
+			report("invalid scope name, expect default, remote-{name}, 8 characters accountHash or profile inherited by other scope")
+		}
+		keys := make([]string, 0, len(raw[name]))
+		for k := range raw[name] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		c := &configure{}
+		for _, k := range keys {
+			if _, ok := c.field(k); !ok {
+				report("unknown key %s", k)
+				continue
+			}
+			if e := c.set(k, raw[name][k]); e != nil {
+				report("%s", e.Error())
+			}
+		}
+		if nc[name].PrivateKeyJSON != "" {
+			if _, e := parsePrivateKeyJSON(nc[name].PrivateKeyJSON); e != nil {
+				report("private_key_json %s", e.Error())
+			}
+		}
+		if remote {
+			// remote scopes never inherit
+			rc := *nc[name]
+			if rc.Provider == "" {
+				rc.Provider = "s3"
+			}
+			for _, k := range []string{"region", "bucket_name", "access_key_id", "secret_access_key"} {
+				if !rc.provided(k) {
+					report("%s is required by provider %s", k, rc.Provider)
+				}
+			}
+			continue
+		}
+		rc, err := nc.resolve(name)
+		if err != nil {
+			report("%s", err.Error())
+			continue
+		}
+		// scopes which hold credentials only don't need striketracker auth keys
+		if (name == ini.DefaultSection && len(raw[name]) > 0) || c.AuthType != "" || c.Username != "" || c.Token != "" {
+			authType, required := "basic", []string{"user_name", "password"}
+			if rc.AuthType == "token" {
+				authType, required = "token", []string{"token"}
+			}
+			for _, k := range required {
+				if !rc.provided(k) {
+					report("%s is required by auth_type %s", k, authType)
+				}
+			}
+		}
+		if rc.CredentialType == "hmac" && (rc.AccessKeyID == "") != (rc.SecretAccessKey == "") {
+			report("access_key_id and secret_access_key must been provided together")
+		}
+	}
+	return problems, nil
+}
+
+// provided whether key has literal value or external source
+func (config *configure) provided(key string) bool {
+	if v, _ := config.get(key); v != "" || config.VaultPath != "" {
+		return true
+	}
+	if src, ok := secretSources[key]; ok {
+		f, _ := config.get(src[0])
+		c, _ := config.get(src[1])
+		return f != "" || c != ""
+	}
+	return false
+}
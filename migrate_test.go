@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		raw     map[string]map[string]string
+		version int
+		want    map[string]map[string]string
+		wantErr bool
+	}{
+		{
+			name: "v1 drops copied auth keys and records credential_type",
+			raw: map[string]map[string]string{
+				ini.DefaultSection: {"user_name": "u", "password": "p"},
+				"a1b2c3d4":         {"user_name": "u", "password": "p", "access_key_id": "id", "secret_access_key": "s"},
+				"e5f6g7h8":         {"user_name": "other", "private_key_json": "e30="},
+			},
+			version: 1,
+			want: map[string]map[string]string{
+				ini.DefaultSection: {"user_name": "u", "password": "p"},
+				"a1b2c3d4":         {"access_key_id": "id", "secret_access_key": "s", "credential_type": "hmac"},
+				"e5f6g7h8":         {"user_name": "other", "private_key_json": "e30=", "credential_type": "private_key"},
+			},
+		},
+		{
+			name: "current version is kept as it is",
+			raw: map[string]map[string]string{
+				ini.DefaultSection: {"version": "2", "user_name": "u"},
+				"a1b2c3d4":         {"user_name": "u"},
+			},
+			version: 2,
+			want: map[string]map[string]string{
+				ini.DefaultSection: {"user_name": "u"},
+				"a1b2c3d4":         {"user_name": "u"},
+			},
+		},
+		{
+			name:    "invalid version",
+			raw:     map[string]map[string]string{ini.DefaultSection: {"version": "x"}},
+			wantErr: true,
+		},
+		{
+			name:    "newer version",
+			raw:     map[string]map[string]string{ini.DefaultSection: {"version": "99"}},
+			version: 99,
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		version, err := migrateConfig(c.raw)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: migrateConfig error = %v, wantErr %v", c.name, err, c.wantErr)
+			continue
+		}
+		if version != c.version {
+			t.Errorf("%s: version = %d, want %d", c.name, version, c.version)
+		}
+		if !c.wantErr && !reflect.DeepEqual(c.raw, c.want) {
+			t.Errorf("%s: migrated %v, want %v", c.name, c.raw, c.want)
+		}
+	}
+}
+
+func TestSaveMigrated(t *testing.T) {
+	v1 := "user_name = u\npassword = p\n\n[a1b2c3d4]\nuser_name = u\npassword = p\naccess_key_id = id\nsecret_access_key = s\n"
+	defer useTempConfig(t, v1)()
+	backup := configFile + ".v1.bak"
+	// backup can't been written, file is kept as it is
+	if err := os.Mkdir(backup, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(configFile); string(b) != v1 {
+		t.Fatalf("configure rewritten without backup:\n%s", b)
+	}
+	os.Remove(backup)
+	nc, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(backup); string(b) != v1 {
+		t.Fatalf("backup = %q, want original file", b)
+	}
+	if v := savedValue(t, ini.DefaultSection, "version"); v != "2" {
+		t.Fatalf("version = %q after migration, want 2", v)
+	}
+	if nc["a1b2c3d4"].Username != "" || nc["a1b2c3d4"].CredentialType != "hmac" {
+		t.Fatalf("migrated scope = %+v", nc["a1b2c3d4"])
+	}
+}
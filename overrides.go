@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"strings"
+)
+
+var (
+	// accountKeys keys of account scope which could been override by flags or HW_* env
+	accountKeys = []string{"auth_type", "user_name", "password", "token", "credential_type", "private_key_json", "access_key_id", "secret_access_key", "rotate_after"}
+	// remoteKeys keys of remote scope which could been override by -remote_* flags or HW_REMOTE_* env
+	remoteKeys = []string{"provider", "region", "bucket_name", "access_key_id", "secret_access_key"}
+
+	flagConf       = &configure{}
+	flagRemoteConf = &configure{}
+	// configReadOnly configure file doesn't exist and all settings come from flags/env, never write hcs.ini
+	configReadOnly bool = false
+)
+
+// registerOverrideFlags register one flag for each overridable key, current values are kept as defaults
+// so flags could been registered by global and command flag sets
+func registerOverrideFlags(fs *flag.FlagSet) {
+	for _, k := range accountKeys {
+		f, _ := flagConf.field(k)
+		p := f.Addr().Interface().(*string)
+		fs.StringVar(p, k, *p, "override "+k+" of selected configure scope, also available as env "+envName("HW_", k))
+	}
+	for _, k := range remoteKeys {
+		f, _ := flagRemoteConf.field(k)
+		p := f.Addr().Interface().(*string)
+		fs.StringVar(p, "remote_"+k, *p, "override "+k+" of remote configure, also available as env "+envName("HW_REMOTE_", k))
+	}
+	fs.StringVar(&flagConf.Username, "u", flagConf.Username, "alias of -user_name")
+	fs.StringVar(&flagConf.Password, "p", flagConf.Password, "alias of -password")
+}
+
+func envName(prefix, key string) string {
+	return prefix + strings.ToUpper(key)
+}
+
+// envConfigure build configure from env, prefix+upper(key) is used as env name
+func envConfigure(prefix string, keys []string) *configure {
+	c := &configure{}
+	for _, k := range keys {
+		c.set(k, os.Getenv(envName(prefix, k)))
+	}
+	return c
+}
+
+// accountOverride return flags > env layer of account keys
+func accountOverride() *configure {
+	c := mergeConfigure(flagConf, envConfigure("HW_", accountKeys))
+	if c.PrivateKeyJSON != "" {
+		// file path is acceptable as well
+		if v, e := parsePrivateKeyJSON(c.PrivateKeyJSON); e == nil {
+			c.PrivateKeyJSON = v
+		}
+	}
+	if c.AuthType == "" {
+		if c.Token != "" {
+			c.AuthType = "token"
+		} else if c.Username != "" {
+			c.AuthType = "basic"
+		}
+	}
+	return c
+}
+
+// remoteOverride return flags > env layer of remote keys
+func remoteOverride() *configure {
+	return mergeConfigure(flagRemoteConf, envConfigure("HW_REMOTE_", remoteKeys))
+}
+
+// hasOverride whether any key was provided by flags or env
+func hasOverride() bool {
+	return !reflect.DeepEqual(*accountOverride(), configure{}) || !reflect.DeepEqual(*remoteOverride(), configure{})
+}
+
+// mergeConfigure return a new configure, first non-empty value of each key wins, nil layers are skipped
+func mergeConfigure(layers ...*configure) *configure {
+	res := &configure{}
+	for _, k := range configKeys() {
+		for _, l := range layers {
+			if l == nil {
+				continue
+			}
+			if v, _ := l.get(k); v != "" {
+				res.set(k, v)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// resolveConfigure resolve account configure, flags > HW_* env > selected scope > inherited scopes > default section
+func (nc nsConfigure) resolveConfigure(scopename string) (*configure, error) {
+	c, err := nc.resolve(scopename)
+	if err != nil {
+		return nil, err
+	}
+	return mergeConfigure(accountOverride(), c), nil
+}
+
+// resolveRemote resolve remote configure, flags > HW_REMOTE_* env > remote scope
+func (nc nsConfigure) resolveRemote(name string) *configure {
+	o := remoteOverride()
+	if nc["remote-"+name] == nil && reflect.DeepEqual(*o, configure{}) {
+		return nil
+	}
+	return mergeConfigure(o, nc["remote-"+name])
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bucloud/hwapi"
+	"gopkg.in/ini.v1"
+)
+
+var (
+	// dryRun resolve hosts and search logs only, nothing is downloaded, generated or saved
+	dryRun bool = false
+	// outputFormat format of plan and listings, table or json
+	outputFormat string = "table"
+)
+
+// hostPlan what download would do for one host
+type hostPlan struct {
+	Host            string   `json:"host"`
+	HostHash        string   `json:"host_hash"`
+	Type            string   `json:"type"`
+	AccountHash     string   `json:"account_hash"`
+	CredentialScope string   `json:"credential_scope"`
+	Generate        string   `json:"generate,omitempty"`
+	Rotate          bool     `json:"rotate,omitempty"`
+	Files           int      `json:"files"`
+	Size            int64    `json:"size"`
+	UnknownSize     int      `json:"unknown_size,omitempty"`
+	Target          string   `json:"target"`
+	Paths           []string `json:"paths,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// downloadPlan plan printed by -dry_run
+type downloadPlan struct {
+	From   time.Time   `json:"from"`
+	To     time.Time   `json:"to"`
+	Types  []string    `json:"types"`
+	Output string      `json:"output"`
+	Hosts  []*hostPlan `json:"hosts"`
+}
+
+// runPlan search logs of hosts and print plan, return 1 when any host couldn't been downloaded
+func runPlan(api *hwapi.HWApi, cu *hwapi.User, hosts []*hwapi.HostName, types []string) int {
+	plan := &downloadPlan{From: start, To: end, Types: types, Output: output}
+	failed := false
+	for _, h := range hosts {
+		for _, t := range types {
+			p := planHost(api, cu, h, t)
+			if p.Error != "" {
+				failed = true
+			}
+			plan.Hosts = append(plan.Hosts, p)
+		}
+	}
+	if outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(plan)
+	} else {
+		plan.print()
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func planHost(api *hwapi.HWApi, cu *hwapi.User, h *hwapi.HostName, t string) *hostPlan {
+	p := &hostPlan{Host: h.Name, HostHash: h.HostHash, Type: t, AccountHash: h.AccountHash, Target: targetDir(h, t)}
+	ac, code := accountCredential(api, cu, h)
+	if code != 0 {
+		p.Error = "resolve configure failed"
+		return p
+	}
+	if o := accountOverride(); o.hasCredential() {
+		p.CredentialScope = "flags/env"
+	} else if n := Cfg.credentialScope(h.AccountHash, cu.AccountHash); n == ini.DefaultSection {
+		p.CredentialScope = "default"
+	} else {
+		p.CredentialScope = n
+	}
+	if resolved, e := Cfg.accountConfigure(h.AccountHash, cu.AccountHash); e == nil && ac.credentialID() == resolved.credentialID() {
+		p.Rotate = resolved.needRotate(ac.RotateAfter)
+	}
+	if !ac.hasCredential() {
+		if !autoGenerateCredential {
+			p.Error = "credential not found, create it or use -auto"
+			return p
+		}
+		p.Generate = "hmac"
+		if ac.CredentialType == "private_key" {
+			p.Generate = "private_key"
+		}
+		// logs can't been searched before credential exists
+		p.Files = -1
+		return p
+	}
+	urls, err := searchLogs(api, h, t, &hwapi.HCSCredentials{AccessKeyID: ac.AccessKeyID, SecretKey: ac.SecretAccessKey, PrivateKeyJSON: ac.PrivateKeyJSON})
+	if err != nil {
+		p.Error = "search logs failed " + err.Error()
+		return p
+	}
+	p.Files = len(urls)
+	for _, u := range urls {
+		p.Paths = append(p.Paths, fileTarget(p.Target, u))
+	}
+	p.Size, p.UnknownSize = urlsSize(api, urls)
+	return p
+}
+
+// fileName name of file in url
+func fileName(rawurl string) string {
+	if u, err := url.Parse(rawurl); err == nil {
+		return path.Base(u.Path)
+	}
+	return path.Base(rawurl)
+}
+
+// urlsSize sum size of urls, return number of urls which size is unknown as well; size is taken from
+// Content-Range of a one byte ranged GET since signed urls are signed for GET only
+func urlsSize(api *hwapi.HWApi, urls []string) (int64, int) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		size    int64
+		unknown int
+	)
+	queue := make(chan string)
+	n := worker
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range queue {
+				var length int64 = -1
+				if req, err := newFileRequest(context.Background(), api, u); err == nil {
+					req.Header.Set("Range", "bytes=0-0")
+					if resp, err := getFile(req); err == nil {
+						length = responseSize(resp)
+						io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<10))
+						resp.Body.Close()
+					}
+				}
+				mu.Lock()
+				if length < 0 {
+					unknown++
+				} else {
+					size += length
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, u := range urls {
+		queue <- u
+	}
+	close(queue)
+	wg.Wait()
+	return size, unknown
+}
+
+// responseSize total size of object from 206 Content-Range or 200 Content-Length, -1 when it's unknown
+func responseSize(resp *http.Response) int64 {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		cr := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if n, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				return n
+			}
+		}
+	case http.StatusOK:
+		return resp.ContentLength
+	}
+	return -1
+}
+
+func (plan *downloadPlan) print() {
+	fmt.Printf("# from %s to %s, type %s, output %s\n", plan.From.Format(time.RFC3339), plan.To.Format(time.RFC3339), strings.Join(plan.Types, ","), plan.Output)
+	fmt.Printf("# %-30s\t%-10s\t%-4s\t%-10s\t%-16s\t%-12s\t%-6s\t%-12s\t%s\n", "Host", "HostHash", "Type", "Account", "CredentialScope", "Generate", "Files", "Size", "Target")
+	var files int
+	var size int64
+	for _, p := range plan.Hosts {
+		generate := p.Generate
+		if p.Rotate {
+			generate = "rotate"
+		}
+		if p.Error != "" {
+			fmt.Printf("  %-30s\t%-10s\t%-4s\t%-10s\t%-16s\terror: %s\n", p.Host, p.HostHash, p.Type, p.AccountHash, p.CredentialScope, p.Error)
+			continue
+		}
+		fileNum, sizeText := fmt.Sprint(p.Files), formatSize(p.Size)
+		if p.Files < 0 {
+			fileNum, sizeText = "?", "?"
+		} else {
+			files += p.Files
+			size += p.Size
+			if p.UnknownSize > 0 {
+				sizeText += fmt.Sprintf("+%d?", p.UnknownSize)
+			}
+		}
+		fmt.Printf("  %-30s\t%-10s\t%-4s\t%-10s\t%-16s\t%-12s\t%-6s\t%-12s\t%s\n", p.Host, p.HostHash, p.Type, p.AccountHash, p.CredentialScope, generate, fileNum, sizeText, p.Target)
+	}
+	fmt.Printf("# %d host/type pairs, %d files, %s\n", len(plan.Hosts), files, formatSize(size))
+}
+
+// formatSize human readable size
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
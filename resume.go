@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/bucloud/hwapi"
+)
+
+// partMeta progress of .part file, kept in {file}.part.meta next to it
+type partMeta struct {
+	Offset     int64      `json:"offset"`
+	ETag       string     `json:"etag,omitempty"`
+	Generation string     `json:"generation,omitempty"`
+	Hash       objectHash `json:"hash"`
+}
+
+// readPartMeta load progress of part, nil returned when part or its meta is missing or unusable
+func readPartMeta(part string) *partMeta {
+	info, err := os.Stat(part)
+	if err != nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(part + ".meta")
+	if err != nil {
+		return nil
+	}
+	m := &partMeta{}
+	if json.Unmarshal(b, m) != nil || m.Offset <= 0 || m.Offset > info.Size() || (m.ETag == "" && m.Generation == "") {
+		return nil
+	}
+	return m
+}
+
+// writePartMeta record progress of part, meta is replaced atomically
+func writePartMeta(part string, m *partMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := part + ".meta.tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, part+".meta")
+}
+
+// fetchPart download url to dst through dst.part, an existing part is resumed by Range request
+// when its ETag/generation still matches remote object, otherwise it's downloaded from zero;
+// progress is recorded when download aborts, so next run continues from there;
+// completed part is verified against checksums of remote object before it's renamed to dst
+func fetchPart(ctx context.Context, api *hwapi.HWApi, dst, rawurl string) (*fileRecord, error) {
+	part := dst + ".part"
+	m := readPartMeta(part)
+	req, err := newFileRequest(ctx, api, rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", m.Offset))
+		if m.ETag != "" {
+			req.Header.Set("If-Range", m.ETag)
+		}
+	}
+	resp, err := getFile(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	generation := resp.Header.Get("X-Goog-Generation")
+	switch resp.StatusCode {
+	case http.StatusOK:
+		m = &partMeta{ETag: resp.Header.Get("ETag"), Generation: generation, Hash: parseObjectHash(resp.Header)}
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		if m == nil {
+			return nil, &statusError{resp.StatusCode, resp.Status}
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable || rangeStart(resp) != m.Offset || (m.Generation != "" && generation != "" && generation != m.Generation) {
+			// remote object changed since part was written, start over
+			logger.Debug().Str("file", dst).Msg("partial file outdated, download from zero")
+			resp.Body.Close()
+			os.Remove(part + ".meta")
+			os.Remove(part)
+			return fetchPart(ctx, api, dst, rawurl)
+		}
+		if oh := parseObjectHash(resp.Header); oh.CRC32C != "" || oh.MD5 != "" {
+			m.Hash = oh
+		}
+		logger.Debug().Str("file", dst).Int64("offset", m.Offset).Msg("resume partial file")
+	default:
+		return nil, &statusError{resp.StatusCode, resp.Status}
+	}
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if m.Offset > 0 {
+		flag = os.O_CREATE | os.O_WRONLY
+	}
+	f, err := os.OpenFile(part, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if m.Offset > 0 {
+		// bytes after recorded offset may not been synced, drop them
+		if err := f.Truncate(m.Offset); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := f.Seek(m.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	n, err := io.Copy(f, resp.Body)
+	if e := f.Sync(); err == nil {
+		err = e
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	m.Offset += n
+	if err != nil {
+		// keep progress only when part could been resumed later
+		if m.Offset > 0 && (m.ETag != "" || m.Generation != "") {
+			if e := writePartMeta(part, m); e != nil {
+				logger.Warn().Err(e).Str("file", part).Msg("record partial file failed")
+			}
+		} else {
+			os.Remove(part)
+		}
+		return nil, err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		writePartMeta(part, m)
+		return nil, fmt.Errorf("short read %d of %d bytes", n, resp.ContentLength)
+	}
+	rec, err := verifyFile(part, m.Hash)
+	if err != nil {
+		if isVerifyError(err) {
+			// corrupted part can't been resumed
+			os.Remove(part)
+			os.Remove(part + ".meta")
+		}
+		return nil, err
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return nil, err
+	}
+	os.Remove(part + ".meta")
+	rec.Target = dst
+	return rec, nil
+}
+
+// rangeStart first byte of Content-Range of 206 response, -1 when it couldn't been parsed
+func rangeStart(resp *http.Response) int64 {
+	var start, end int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/", &start, &end); err != nil {
+		return -1
+	}
+	return start
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// objectServer serve body like GCS does, Range is honored unless etag changed, hash is sent in X-Goog-Hash
+type objectServer struct {
+	body   string
+	etag   string
+	hash   string
+	ranges []string
+}
+
+func (s *objectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	w.Header().Set("ETag", s.etag)
+	w.Header().Set("X-Goog-Hash", "md5="+s.hash)
+	var start int
+	if rg := r.Header.Get("Range"); rg != "" && r.Header.Get("If-Range") == s.etag {
+		fmt.Sscanf(rg, "bytes=%d-", &start)
+		if start >= len(s.body) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(s.body)-1, len(s.body)))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	w.Write([]byte(s.body[start:]))
+}
+
+func md5Base64(s string) string {
+	sum := md5.Sum([]byte(s))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// fetchPartTest fetch object of srv into temp dir, part holds content of existing part file written at offset
+func fetchPartTest(t *testing.T, srv *objectServer, part string, offset int64) (string, *fileRecord, error) {
+	dir, err := ioutil.TempDir("", "part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	dst := filepath.Join(dir, "x.log")
+	if part != "" {
+		if err := ioutil.WriteFile(dst+".part", []byte(part), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writePartMeta(dst+".part", &partMeta{Offset: offset, ETag: "e1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	rec, err := fetchPart(context.Background(), nil, dst, ts.URL+"/b/x.log")
+	return dst, rec, err
+}
+
+func TestFetchPart(t *testing.T) {
+	body := "0123456789abcdefghij"
+	cases := []struct {
+		name   string
+		etag   string
+		part   string
+		offset int64
+		ranges []string
+	}{
+		{"fresh", "e1", "", 0, []string{""}},
+		{"resume", "e1", "0123456789", 10, []string{"bytes=10-"}},
+		// bytes after recorded offset are dropped
+		{"resume unsynced tail", "e1", "01234567xx", 8, []string{"bytes=8-"}},
+		{"object changed", "e2", "0123456789", 10, []string{"bytes=10-"}},
+		{"range not satisfiable", "e1", body + "xx", 22, []string{"bytes=22-", ""}},
+	}
+	for _, c := range cases {
+		srv := &objectServer{body: body, etag: c.etag, hash: md5Base64(body)}
+		dst, rec, err := fetchPartTest(t, srv, c.part, c.offset)
+		if err != nil {
+			t.Errorf("%s: fetchPart failed %s", c.name, err)
+			continue
+		}
+		if b, _ := ioutil.ReadFile(dst); string(b) != body {
+			t.Errorf("%s: file = %q, want %q", c.name, b, body)
+		}
+		if rec.Size != int64(len(body)) || rec.Target != dst {
+			t.Errorf("%s: record %+v", c.name, rec)
+		}
+		if strings.Join(srv.ranges, ",") != strings.Join(c.ranges, ",") {
+			t.Errorf("%s: ranges %q, want %q", c.name, srv.ranges, c.ranges)
+		}
+		for _, f := range []string{dst + ".part", dst + ".part.meta"} {
+			if _, err := os.Stat(f); !os.IsNotExist(err) {
+				t.Errorf("%s: %s is kept", c.name, f)
+			}
+		}
+	}
+}
+
+func TestFetchPartVerifyFailed(t *testing.T) {
+	srv := &objectServer{body: "0123456789", etag: "e1", hash: md5Base64("something else")}
+	dst, _, err := fetchPartTest(t, srv, "", 0)
+	if !isVerifyError(err) {
+		t.Fatalf("fetchPart = %v, want verify error", err)
+	}
+	for _, f := range []string{dst, dst + ".part", dst + ".part.meta"} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s is kept", f)
+		}
+	}
+}
+
+func TestFetchPartStalled(t *testing.T) {
+	defer func(d time.Duration) { fileStallTimeout = d }(fileStallTimeout)
+	fileStallTimeout = 100 * time.Millisecond
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", "e1")
+		w.Header().Set("Content-Length", "20")
+		w.Write([]byte("0123456789"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	dir, err := ioutil.TempDir("", "part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "x.log")
+	_, err = fetchPart(context.Background(), nil, dst, ts.URL+"/b/x.log")
+	if _, ok := err.(stallError); !ok || !retryable(err) {
+		t.Fatalf("fetchPart = %v, want retryable stall error", err)
+	}
+	// progress is kept, so next attempt resumes
+	if m := readPartMeta(dst + ".part"); m == nil || m.Offset != 10 {
+		t.Fatalf("part meta = %+v, want offset 10", m)
+	}
+}
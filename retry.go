@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	// retries times a failed api call or download is retried when error is retryable
+	retries int = 3
+	// retryWait wait before first retry, it's doubled after each retry up to maxRetryWait and jittered
+	retryWait time.Duration = time.Second
+)
+
+const maxRetryWait = time.Minute
+
+// statusError unexpected http status of raw log url
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "unexpected status " + e.status
+}
+
+// status phrases of text errors, hwapi reports failed requests as "{url} : {status}", bare numbers aren't matched
+// since they could be part of host names or messages
+var (
+	retryableStatus = regexp.MustCompile(` : (408|429|5\d\d) |(?i)\bstatus (code )?(408|429|5\d\d)\b|timeout|timed out|connection reset|connection refused|broken pipe`)
+	fatalStatus     = regexp.MustCompile(` : (401|403) |(?i)\bstatus (code )?(401|403)\b|unauthorized|forbidden`)
+)
+
+// retryableCode whether http status is transient, throttling (429), request timeout (408) and server errors (5xx)
+func retryableCode(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+// retryable whether err is transient, throttling (429), server errors (5xx), timeouts and broken connections are retried,
+// auth failures (401/403) and other client errors are fatal. Typed errors of raw log urls, S3 and GCS are checked first,
+// errors of hwapi only carry message so explicit status phrases are matched then
+func retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || isVerifyError(err) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return retryableCode(se.code)
+	}
+	var ae awserr.Error
+	// SlowDown is throttling of S3, sdk doesn't list it
+	if errors.As(err, &ae) && (request.IsErrorRetryable(ae) || request.IsErrorThrottle(ae) || ae.Code() == "SlowDown") {
+		return true
+	}
+	var rf awserr.RequestFailure
+	if errors.As(err, &rf) && rf.StatusCode() > 0 {
+		return retryableCode(rf.StatusCode())
+	}
+	var ge *googleapi.Error
+	if errors.As(err, &ge) && ge.Code > 0 {
+		return retryableCode(ge.Code)
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	msg := err.Error()
+	return !fatalStatus.MatchString(msg) && retryableStatus.MatchString(msg)
+}
+
+// backoff wait before retry attempt (starts from 0), half of it is random so concurrent retries spread
+func backoff(attempt int) time.Duration {
+	d := retryWait << uint(attempt)
+	if d <= 0 || d > maxRetryWait {
+		d = maxRetryWait
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retry call fn until it succeeds, fails with fatal error or -retries is exhausted, waiting is interrupted by ctx
+func retry(ctx context.Context, op string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retries || !retryable(err) || ctx.Err() != nil {
+			if err != nil && attempt > 0 {
+				return fmt.Errorf("%s failed after %d attempts: %w", op, attempt+1, err)
+			}
+			return err
+		}
+		wait := backoff(attempt)
+		logger.Warn().Err(err).Str("op", op).Int("attempt", attempt+1).Dur("wait", wait).Msg("retry")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
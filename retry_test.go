@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&statusError{503, "503 Service Unavailable"}, true},
+		{&statusError{429, "429 Too Many Requests"}, true},
+		{&statusError{404, "404 Not Found"}, false},
+		{&statusError{403, "403 Forbidden"}, false},
+		{fmt.Errorf("fetch x.gz failed: %w", &statusError{500, "500 Internal Server Error"}), true},
+		{stallError{}, true},
+		{&url.Error{Op: "Get", URL: "https://h/x", Err: io.EOF}, true},
+		{io.ErrUnexpectedEOF, true},
+		{context.Canceled, false},
+		{&verifyError{"md5 mismatch"}, false},
+		// S3 and GCS errors
+		{awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "Service Unavailable", nil), 503, "r1"), true},
+		{awserr.NewRequestFailure(awserr.New("RequestTimeout", "Your socket connection to the server was not read from", nil), 400, "r1"), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "r1"), false},
+		{awserr.New("SlowDown", "Please reduce your request rate.", nil), true},
+		{fmt.Errorf("upload x.gz failed: %w", awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error", nil), 500, "r1")), true},
+		{&googleapi.Error{Code: 503, Message: "Backend Error"}, true},
+		{&googleapi.Error{Code: 429, Message: "rateLimitExceeded"}, true},
+		{&googleapi.Error{Code: 403, Message: "Forbidden"}, false},
+		// hwapi text errors
+		{errors.New("https://striketracker.highwinds.com/api/v1/accounts/a1/search : 502 Bad Gateway"), true},
+		{errors.New("https://striketracker.highwinds.com/api/v1/accounts/a1/search : 429 Too Many Requests"), true},
+		{errors.New("https://striketracker.highwinds.com/api/v1/accounts/a1/search : 401 Unauthorized"), false},
+		{errors.New("unexpected status code 503"), true},
+		{errors.New("dial tcp 10.0.0.1:443: connect: connection refused"), true},
+		{errors.New("read tcp: connection reset by peer"), true},
+		{errors.New("host 512 not found"), false},
+		{errors.New("account a500b not found"), false},
+		{errors.New("https://striketracker.highwinds.com/api/v1/accounts/a1/search : invalid host hash"), false},
+		{errors.New("status 503 but unauthorized"), false},
+	}
+	for _, c := range cases {
+		if got := retryable(c.err); got != c.want {
+			t.Errorf("retryable(%v) = %t, want %t", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(n int, w time.Duration) { retries, retryWait = n, w }(retries, retryWait)
+	retries, retryWait = 2, time.Millisecond
+	calls := 0
+	err := retry(context.Background(), "op", func() error {
+		calls++
+		return &statusError{503, "503 Service Unavailable"}
+	})
+	if calls != 3 || err == nil {
+		t.Fatalf("retry called fn %d times, err %v, want 3 times and error", calls, err)
+	}
+	var se *statusError
+	if !errors.As(err, &se) {
+		t.Fatalf("retry error %v doesn't wrap last error", err)
+	}
+	calls = 0
+	retry(context.Background(), "op", func() error {
+		calls++
+		return &statusError{404, "404 Not Found"}
+	})
+	if calls != 1 {
+		t.Fatalf("fatal error retried, fn called %d times", calls)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// secretSources keys which could been read from file or command, key => {file key, command key}
+var secretSources = map[string][2]string{
+	"password":          {"password_file", "password_command"},
+	"token":             {"token_file", "token_command"},
+	"secret_access_key": {"secret_access_key_file", "secret_access_key_command"},
+}
+
+// secretCache cache of command and vault results, commands run only once per process
+var secretCache = make(map[string]string)
+
+// resolveSecrets fill empty secrets from file, command, then vault, literal values always win
+func (config *configure) resolveSecrets() error {
+	for k, src := range secretSources {
+		if v, _ := config.get(k); v != "" {
+			continue
+		}
+		if f, _ := config.get(src[0]); f != "" {
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				return fmt.Errorf("read %s from %s failed %s", k, f, err.Error())
+			}
+			config.set(k, strings.TrimSpace(string(b)))
+			continue
+		}
+		if c, _ := config.get(src[1]); c != "" {
+			v, err := runSecretCommand(c)
+			if err != nil {
+				return fmt.Errorf("read %s from command failed %s", k, err.Error())
+			}
+			config.set(k, v)
+		}
+	}
+	if config.VaultPath == "" {
+		return nil
+	}
+	data, err := readVault(config.VaultAddr, config.VaultPath)
+	if err != nil {
+		return err
+	}
+	for _, k := range configKeys() {
+		if v, _ := config.get(k); v != "" || data[k] == "" {
+			continue
+		}
+		if e := config.set(k, data[k]); e != nil {
+			return fmt.Errorf("vault secret %s %s", config.VaultPath, e.Error())
+		}
+	}
+	return nil
+}
+
+// runSecretCommand run command in shell, trimmed stdout is used as value
+func runSecretCommand(command string) (string, error) {
+	if v, ok := secretCache["command:"+command]; ok {
+		return v, nil
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	v := strings.TrimSpace(string(out))
+	if v == "" {
+		return "", fmt.Errorf("command output nothing")
+	}
+	secretCache["command:"+command] = v
+	return v, nil
+}
+
+// readVault read KV secret from vault, both KV v1 and v2 are supported
+func readVault(addr, path string) (map[string]string, error) {
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("vault address not found, set vault_addr or VAULT_ADDR")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		b, err := ioutil.ReadFile(homeDir(".vault-token"))
+		if err != nil {
+			return nil, fmt.Errorf("vault token not found, set VAULT_TOKEN or login by vault cli")
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	url := strings.TrimRight(addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	if v, ok := secretCache["vault:"+url]; ok {
+		data := make(map[string]string)
+		json.Unmarshal([]byte(v), &data)
+		return data, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("read vault secret %s failed %s", path, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("read vault secret %s failed, status %s", path, resp.Status)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("parse vault secret %s failed %s", path, err.Error())
+	}
+	// KV v2 wraps secret in data.data
+	values := body.Data
+	if inner, ok := body.Data["data"].(map[string]interface{}); ok {
+		values = inner
+	}
+	data := make(map[string]string)
+	for k, v := range values {
+		if s, ok := v.(string); ok {
+			data[k] = s
+		}
+	}
+	b, _ := json.Marshal(data)
+	secretCache["vault:"+url] = string(b)
+	return data, nil
+}
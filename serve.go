@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// listenAddr address serve command listens on
+var listenAddr string = "127.0.0.1:8080"
+
+// roundStatus status of download rounds, reported by serve command
+type roundStatus struct {
+	mu        sync.Mutex
+	Started   time.Time `json:"started"`
+	Rounds    int       `json:"rounds"`
+	LastRound time.Time `json:"last_round,omitempty"`
+	From      time.Time `json:"from,omitempty"`
+	To        time.Time `json:"to,omitempty"`
+	Hosts     int       `json:"hosts"`
+}
+
+var serveStatus = &roundStatus{Started: time.Now().UTC()}
+
+// update record a finished download round
+func (s *roundStatus) update(from, to time.Time, hosts int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Rounds++
+	s.LastRound = time.Now().UTC()
+	s.From, s.To, s.Hosts = from, to, hosts
+}
+
+func (s *roundStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func serveFlags(fs *flag.FlagSet) {
+	downloadFlags(fs)
+	fs.StringVar(&listenAddr, "listen", listenAddr, "address to report status on, GET /status returns rounds finished, /healthz returns ok")
+}
+
+// runServeCommand run download in loop, one hour is used when -loop absent, status server stops with download
+func runServeCommand(ctx context.Context, fs *flag.FlagSet) int {
+	if loopInterval <= 0 {
+		loopInterval = time.Hour
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/status", serveStatus)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	srv := &http.Server{Addr: listenAddr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error().Err(err).Str("listen", listenAddr).Msg("status server stopped")
+		}
+	}()
+	defer srv.Close()
+	logger.Info().Str("listen", listenAddr).Dur("loop", loopInterval).Msg("serve started")
+	return runDownloadCommand(ctx, fs)
+}
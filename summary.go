@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// exitPartial exit code when some host/type pairs failed while others succeeded
+const exitPartial = 8
+
+// pairResult result of one host/type pair in a download round
+type pairResult struct {
+	Host       string
+	HostHash   string
+	Type       string
+	Files      int
+	Downloaded int
+	Skipped    int
+	Failed     int
+	Err        string
+}
+
+func (p *pairResult) failed() bool {
+	return p.Err != "" || p.Failed > 0
+}
+
+// runSummary results of a download round, printed when round completes or is interrupted;
+// pairs are indexed by host and type, so concurrent hosts fill their own slots and nil ones were never started
+type runSummary struct {
+	pairs []*pairResult
+}
+
+// results pairs which were started, in order of hosts
+func (s *runSummary) results() []*pairResult {
+	started := make([]*pairResult, 0, len(s.pairs))
+	for _, p := range s.pairs {
+		if p != nil {
+			started = append(started, p)
+		}
+	}
+	return started
+}
+
+// exitCode 0 when every pair succeeded, 1 when all of them failed, exitPartial otherwise
+func (s *runSummary) exitCode() int {
+	failed, pairs := 0, s.results()
+	for _, p := range pairs {
+		if p.failed() {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return 0
+	case failed == len(pairs):
+		return 1
+	}
+	return exitPartial
+}
+
+func (s *runSummary) print(w io.Writer) {
+	var failed, files, downloaded, skipped, failedFiles int
+	pairs := s.results()
+	for _, p := range pairs {
+		files += p.Files
+		downloaded += p.Downloaded
+		skipped += p.Skipped
+		failedFiles += p.Failed
+		if !p.failed() {
+			continue
+		}
+		failed++
+		reason := p.Err
+		if reason == "" {
+			reason = fmt.Sprintf("%d of %d files failed", p.Failed, p.Files)
+		}
+		fmt.Fprintf(w, "  failed %s(%s) %s: %s\n", p.Host, p.HostHash, p.Type, reason)
+	}
+	fmt.Fprintf(w, "# %d host/type pairs, %d succeeded, %d failed; %d files, %d downloaded, %d skipped, %d failed\n",
+		len(pairs), len(pairs)-failed, failed, files, downloaded, skipped, failedFiles)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunSummary(t *testing.T) {
+	ok := &pairResult{Host: "a.example.com", HostHash: "h1", Type: "cds", Files: 3, Downloaded: 2, Skipped: 1}
+	partial := &pairResult{Host: "b.example.com", HostHash: "h2", Type: "cds", Files: 4, Downloaded: 3, Failed: 1}
+	search := &pairResult{Host: "c.example.com", HostHash: "h3", Type: "origin", Err: "search logs failed 401 Unauthorized"}
+	cases := []struct {
+		pairs []*pairResult
+		code  int
+	}{
+		{nil, 0},
+		{[]*pairResult{ok, nil}, 0},
+		{[]*pairResult{ok, partial}, exitPartial},
+		{[]*pairResult{ok, nil, search}, exitPartial},
+		{[]*pairResult{partial, search}, 1},
+		// pairs never started don't count
+		{[]*pairResult{nil, search, nil}, 1},
+	}
+	for i, c := range cases {
+		s := &runSummary{pairs: c.pairs}
+		if got := s.exitCode(); got != c.code {
+			t.Errorf("case %d: exitCode() = %d, want %d", i, got, c.code)
+		}
+	}
+
+	var buf bytes.Buffer
+	(&runSummary{pairs: []*pairResult{ok, partial, nil, search}}).print(&buf)
+	want := []string{
+		"  failed b.example.com(h2) cds: 1 of 4 files failed",
+		"  failed c.example.com(h3) origin: search logs failed 401 Unauthorized",
+		"# 3 host/type pairs, 1 succeeded, 2 failed; 7 files, 5 downloaded, 1 skipped, 1 failed",
+	}
+	if got := strings.TrimRight(buf.String(), "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("print() = %q, want %q", got, strings.Join(want, "\n"))
+	}
+}
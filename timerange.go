@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeZone -tz, used by date-only and zoneless time values, also by today/yesterday
+var timeZone string = "UTC"
+
+// timeLayouts layouts without zone, interpreted in -tz
+var timeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+var (
+	relativePattern = regexp.MustCompile(`^(now|today|yesterday)?\s*(?:([+-])\s*([0-9][0-9a-zµ.]*))?$`)
+	dayUnitPattern  = regexp.MustCompile(`([0-9]+(?:\.[0-9]+)?)([dw])`)
+)
+
+// parseTimeRange parse -s/-e into start/end, start defaults to 24 hours ago, end defaults to now
+func parseTimeRange() error {
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return fmt.Errorf("invalid -tz %s", timeZone)
+	}
+	now := time.Now()
+	start, end = now.UTC().Add(-time.Hour*24), now.UTC()
+	if startFlag != "" {
+		if start, err = parseTime(startFlag, now, loc); err != nil {
+			return fmt.Errorf("invalid -s %s", err.Error())
+		}
+	}
+	if endFlag != "" {
+		if end, err = parseTime(endFlag, now, loc); err != nil {
+			return fmt.Errorf("invalid -e %s", err.Error())
+		}
+	}
+	if !start.Before(end) {
+		return fmt.Errorf("start %s must been before end %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// parseTime accept RFC3339 with offset, zoneless or date-only time in loc,
+// and relative expressions such like -2h, now-1d, yesterday, today+8h
+func parseTime(s string, now time.Time, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	m := relativePattern.FindStringSubmatch(strings.ToLower(s))
+	if m == nil || (m[1] == "" && m[2] == "") {
+		return time.Time{}, fmt.Errorf("%q, expect RFC3339, 2006-01-02[ 15:04[:05]], now, today, yesterday or relative expression such like -2h, now-1d", s)
+	}
+	base := now.In(loc)
+	switch m[1] {
+	case "today":
+		base = time.Date(base.Year(), base.Month(), base.Day(), 0, 0, 0, 0, loc)
+	case "yesterday":
+		base = time.Date(base.Year(), base.Month(), base.Day()-1, 0, 0, 0, 0, loc)
+	}
+	if m[2] == "" {
+		return base.UTC(), nil
+	}
+	d, err := parseDuration(m[3])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q, %s", s, err.Error())
+	}
+	if m[2] == "-" {
+		d = -d
+	}
+	return base.Add(d).UTC(), nil
+}
+
+// parseDuration time.ParseDuration with d(24h) and w(168h) units
+func parseDuration(s string) (time.Duration, error) {
+	var err error
+	s = dayUnitPattern.ReplaceAllStringFunc(s, func(v string) string {
+		n, e := strconv.ParseFloat(v[:len(v)-1], 64)
+		if e != nil {
+			err = e
+			return v
+		}
+		if v[len(v)-1] == 'w' {
+			n *= 7
+		}
+		return strconv.FormatFloat(n*24, 'f', -1, 64) + "h"
+	})
+	if err != nil {
+		return 0, err
+	}
+	return time.ParseDuration(s)
+}
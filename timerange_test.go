@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 30, 0, 0, time.UTC)
+	loc := time.FixedZone("UTC+8", 8*3600)
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"2026-03-01T00:00:00+02:00", "2026-02-28T22:00:00Z"},
+		{"2026-03-01T00:00:00.5Z", "2026-03-01T00:00:00.5Z"},
+		{"2026-03-01", "2026-02-28T16:00:00Z"},
+		{"2026-03-01 08:30", "2026-03-01T00:30:00Z"},
+		{"2026-03-01T08:30:15", "2026-03-01T00:30:15Z"},
+		{"now", "2026-03-10T15:30:00Z"},
+		{"-2h", "2026-03-10T13:30:00Z"},
+		{"now-1d", "2026-03-09T15:30:00Z"},
+		{"now - 1.5d", "2026-03-09T03:30:00Z"},
+		{"today", "2026-03-09T16:00:00Z"},
+		{"yesterday", "2026-03-08T16:00:00Z"},
+		{"today+8h", "2026-03-10T00:00:00Z"},
+		{"Yesterday-1w", "2026-03-01T16:00:00Z"},
+	}
+	for _, c := range cases {
+		got, err := parseTime(c.in, now, loc)
+		if err != nil {
+			t.Errorf("parseTime(%q) failed %s", c.in, err)
+			continue
+		}
+		if s := got.Format(time.RFC3339Nano); s != c.want {
+			t.Errorf("parseTime(%q) = %s, want %s", c.in, s, c.want)
+		}
+	}
+	for _, in := range []string{"", "tomorrow", "now+", "-2x", "2026-13-01"} {
+		if got, err := parseTime(in, now, loc); err == nil {
+			t.Errorf("parseTime(%q) = %s, want error", in, got)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	cases := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"90m", 90 * time.Minute},
+		{"1d", 24 * time.Hour},
+		{"1.5d", 36 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"1d12h", 36 * time.Hour},
+	}
+	for _, c := range cases {
+		got, err := parseDuration(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("parseDuration(%q) = %s, %v, want %s", c.in, got, err, c.want)
+		}
+	}
+	for _, in := range []string{"", "d", "1x"} {
+		if _, err := parseDuration(in); err == nil {
+			t.Errorf("parseDuration(%q) succeeded, want error", in)
+		}
+	}
+}
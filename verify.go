@@ -0,0 +1,214 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// verifyRetries times a file is fetched again when it fails verification
+var verifyRetries int = 2
+
+// objectHash base64 encoded checksums of remote object, parsed from X-Goog-Hash
+type objectHash struct {
+	CRC32C string `json:"crc32c,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+}
+
+// parseObjectHash read X-Goog-Hash headers, e.g. crc32c=n03x6A==,md5=Ojk9c3dhfxgoKVVHYwFbHQ==
+func parseObjectHash(header http.Header) objectHash {
+	var oh objectHash
+	for _, v := range header.Values("X-Goog-Hash") {
+		for _, kv := range strings.Split(v, ",") {
+			kv = strings.TrimSpace(kv)
+			if strings.HasPrefix(kv, "crc32c=") {
+				oh.CRC32C = strings.TrimPrefix(kv, "crc32c=")
+			} else if strings.HasPrefix(kv, "md5=") {
+				oh.MD5 = strings.TrimPrefix(kv, "md5=")
+			}
+		}
+	}
+	return oh
+}
+
+// verifyError file doesn't match remote object, it's fetched again
+type verifyError struct {
+	msg string
+}
+
+func (e *verifyError) Error() string {
+	return "verify failed " + e.msg
+}
+
+func isVerifyError(err error) bool {
+	var ve *verifyError
+	return errors.As(err, &ve)
+}
+
+// verifier checksum data written to it, gzip stream is validated as well when file is .gz
+type verifier struct {
+	crc   hash.Hash32
+	md5   hash.Hash
+	size  int64
+	pw    *io.PipeWriter
+	gzErr chan error
+}
+
+func newVerifier(name string) *verifier {
+	v := &verifier{crc: crc32.New(crc32.MakeTable(crc32.Castagnoli)), md5: md5.New()}
+	if strings.HasSuffix(name, ".gz") {
+		pr, pw := io.Pipe()
+		v.pw, v.gzErr = pw, make(chan error, 1)
+		go func() {
+			zr, err := gzip.NewReader(pr)
+			if err == nil {
+				_, err = io.Copy(ioutil.Discard, zr)
+			}
+			if err != nil {
+				pr.CloseWithError(err)
+			} else {
+				pr.Close()
+			}
+			v.gzErr <- err
+		}()
+	}
+	return v
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	v.crc.Write(p)
+	v.md5.Write(p)
+	v.size += int64(len(p))
+	if v.pw != nil {
+		// invalid gzip stream is reported by check, data still goes to checksums
+		if _, err := v.pw.Write(p); err != nil {
+			v.pw = nil
+		}
+	}
+	return len(p), nil
+}
+
+// check compare checksums with expected ones and wait gzip validation, return record of file
+func (v *verifier) check(expect objectHash) (*fileRecord, error) {
+	crc := make([]byte, 4)
+	sum := v.crc.Sum32()
+	crc[0], crc[1], crc[2], crc[3] = byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum)
+	rec := &fileRecord{
+		Size:   v.size,
+		CRC32C: base64.StdEncoding.EncodeToString(crc),
+		MD5:    base64.StdEncoding.EncodeToString(v.md5.Sum(nil)),
+	}
+	if v.gzErr != nil {
+		if v.pw != nil {
+			v.pw.Close()
+		}
+		if err := <-v.gzErr; err != nil {
+			return rec, &verifyError{"invalid gzip stream " + err.Error()}
+		}
+		rec.Verified = append(rec.Verified, "gzip")
+	}
+	if expect.CRC32C != "" {
+		if expect.CRC32C != rec.CRC32C {
+			return rec, &verifyError{fmt.Sprintf("crc32c %s expected, got %s", expect.CRC32C, rec.CRC32C)}
+		}
+		rec.Verified = append(rec.Verified, "crc32c")
+	}
+	if expect.MD5 != "" {
+		if expect.MD5 != rec.MD5 {
+			return rec, &verifyError{fmt.Sprintf("md5 %s expected, got %s", expect.MD5, rec.MD5)}
+		}
+		rec.Verified = append(rec.Verified, "md5")
+	}
+	return rec, nil
+}
+
+// abort stop gzip validation of aborted download
+func (v *verifier) abort() {
+	if v.pw != nil {
+		v.pw.CloseWithError(io.ErrUnexpectedEOF)
+	}
+	if v.gzErr != nil {
+		<-v.gzErr
+	}
+}
+
+// verifyFile verify file on disk against expected checksums
+func verifyFile(file string, expect objectHash) (*fileRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	v := newVerifier(strings.TrimSuffix(file, ".part"))
+	if _, err := io.Copy(v, f); err != nil {
+		v.abort()
+		return nil, err
+	}
+	return v.check(expect)
+}
+
+// fileRecord verified file, one line of manifest
+type fileRecord struct {
+	HostHash   string    `json:"host_hash"`
+	Type       string    `json:"type"`
+	File       string    `json:"file"`
+	Target     string    `json:"target"`
+	Size       int64     `json:"size"`
+	CRC32C     string    `json:"crc32c"`
+	MD5        string    `json:"md5"`
+	Verified   []string  `json:"verified"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// manifest verified files of one run, written to {state dir}.manifests/{run start}.jsonl
+type manifest struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func newManifest(dir string, ts time.Time) *manifest {
+	return &manifest{path: filepath.Join(dir, ts.UTC().Format("20060102T150405Z")+".jsonl")}
+}
+
+// add append record, file is created by first record so runs download nothing leave no manifest
+func (m *manifest) add(rec *fileRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.f == nil {
+		if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(m.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		m.f = f
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = m.f.Write(append(b, '\n'))
+	return err
+}
+
+func (m *manifest) close() error {
+	if m.f == nil {
+		return nil
+	}
+	return m.f.Close()
+}